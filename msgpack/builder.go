@@ -0,0 +1,176 @@
+package msgpack
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// errBuilderComplete is returned for values added after the Builder's
+// top-level value is complete.
+var errBuilderComplete = errors.New("msgpack: Builder: message is already complete")
+
+// Builder constructs an encoded message from chained calls, without
+// building Go values for Marshal first:
+//
+//	b, err := msgpack.NewBuilder().
+//		Map(2).
+//		Str("id").Int(7).
+//		Str("tags").Array(2).Str("a").Str("b").
+//		Bytes()
+//
+// A Builder holds a single top-level value. Array(n) and Map(n) declare how
+// many elements or entries follow, and a container is complete once it has
+// that many children. Adding a value after the top-level value is complete,
+// or calling Bytes before it is, is an error. The first error is kept and
+// returned by Bytes, and later calls do nothing.
+type Builder struct {
+	buf bytes.Buffer
+	enc *Encoder
+	// open holds the containers still expecting children, innermost last.
+	open []builderContainer
+	done bool
+	err  error
+}
+
+type builderContainer struct {
+	isMap     bool
+	size      int
+	remaining int
+}
+
+func NewBuilder() *Builder {
+	b := new(Builder)
+	b.enc = NewEncoder(&b.buf)
+	return b
+}
+
+// Encoder returns the Encoder the Builder writes with, for setting encoding
+// options.
+func (b *Builder) Encoder() *Encoder {
+	return b.enc
+}
+
+func (b *Builder) Nil() *Builder {
+	return b.add(b.enc.EncodeNil)
+}
+
+func (b *Builder) Bool(v bool) *Builder {
+	return b.add(func() error { return b.enc.EncodeBool(v) })
+}
+
+func (b *Builder) Int(n int64) *Builder {
+	return b.add(func() error { return b.enc.EncodeInt(n) })
+}
+
+func (b *Builder) Uint(n uint64) *Builder {
+	return b.add(func() error { return b.enc.EncodeUint(n) })
+}
+
+func (b *Builder) Float32(n float32) *Builder {
+	return b.add(func() error { return b.enc.EncodeFloat32(n) })
+}
+
+func (b *Builder) Float64(n float64) *Builder {
+	return b.add(func() error { return b.enc.EncodeFloat64(n) })
+}
+
+func (b *Builder) Str(s string) *Builder {
+	return b.add(func() error { return b.enc.EncodeString(s) })
+}
+
+func (b *Builder) Bin(v []byte) *Builder {
+	return b.add(func() error { return b.enc.EncodeBytes(v) })
+}
+
+func (b *Builder) Ext(typ int8, data []byte) *Builder {
+	return b.add(func() error { return b.enc.EncodeExt(typ, data) })
+}
+
+// Value adds v encoded as by Encoder.Encode, as a single child.
+func (b *Builder) Value(v interface{}) *Builder {
+	return b.add(func() error { return b.enc.Encode(v) })
+}
+
+// Array starts an array; the next n values are its elements.
+func (b *Builder) Array(n int) *Builder {
+	if n < 0 {
+		return b.add(func() error { return fmt.Errorf("msgpack: Builder: array of %d elements", n) })
+	}
+	if b.add(func() error { return b.enc.EncodeArrayLen(n) }); b.err == nil {
+		b.push(builderContainer{size: n, remaining: n})
+	}
+	return b
+}
+
+// Map starts a map; the next 2*n values are its keys and values,
+// alternating.
+func (b *Builder) Map(n int) *Builder {
+	if n < 0 {
+		return b.add(func() error { return fmt.Errorf("msgpack: Builder: map of %d entries", n) })
+	}
+	if b.add(func() error { return b.enc.EncodeMapLen(n) }); b.err == nil {
+		b.push(builderContainer{isMap: true, size: n, remaining: 2 * n})
+	}
+	return b
+}
+
+// Bytes returns the encoded message, or the first error met while building
+// it. It fails if a container has fewer children than declared.
+func (b *Builder) Bytes() ([]byte, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	if len(b.open) > 0 {
+		c := b.open[len(b.open)-1]
+		return nil, fmt.Errorf("msgpack: Builder: %s is missing %d children", c, c.remaining)
+	}
+	if !b.done {
+		return nil, errors.New("msgpack: Builder: no value")
+	}
+	return b.buf.Bytes(), nil
+}
+
+// add writes a child with encode and records it in the innermost open
+// container. Nothing is written once the Builder has failed or is
+// complete.
+func (b *Builder) add(encode func() error) *Builder {
+	if b.err != nil {
+		return b
+	}
+	if b.done {
+		b.err = errBuilderComplete
+		return b
+	}
+	if err := encode(); err != nil {
+		b.err = err
+		return b
+	}
+	if len(b.open) > 0 {
+		b.open[len(b.open)-1].remaining--
+	}
+	b.closeFull()
+	return b
+}
+
+func (b *Builder) push(c builderContainer) {
+	b.done = false
+	b.open = append(b.open, c)
+	b.closeFull()
+}
+
+// closeFull closes the innermost containers that have all their children,
+// and marks the message complete once none is left open.
+func (b *Builder) closeFull() {
+	for len(b.open) > 0 && b.open[len(b.open)-1].remaining == 0 {
+		b.open = b.open[:len(b.open)-1]
+	}
+	b.done = len(b.open) == 0
+}
+
+func (c builderContainer) String() string {
+	if c.isMap {
+		return fmt.Sprintf("map of %d entries", c.size)
+	}
+	return fmt.Sprintf("array of %d elements", c.size)
+}
@@ -0,0 +1,129 @@
+package msgpack
+
+import (
+	"bytes"
+	"hash"
+	"math"
+	"sort"
+)
+
+// Equal reports whether the encoded documents a and b hold the same data,
+// regardless of how it was encoded: integer and float widths, str, bin,
+// array and map header widths, and map key order are not significant.
+// Integers equal in value are equal whatever their signedness, and a float
+// equals a double of the same value. Str and bin, and integers and floats,
+// stay distinct.
+func Equal(a, b []byte) (bool, error) {
+	ca, err := canonicalBytes(a)
+	if err != nil {
+		return false, err
+	}
+	cb, err := canonicalBytes(b)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(ca, cb), nil
+}
+
+// Hash writes a canonical form of the encoded document b to h, so that
+// documents that are Equal hash the same.
+func Hash(b []byte, h hash.Hash) error {
+	c, err := canonicalBytes(b)
+	if err != nil {
+		return err
+	}
+	_, err = h.Write(c)
+	return err
+}
+
+// compareValues orders canonical Values: by Kind first, then by value. It
+// agrees with the order the Encoder writes Go map keys in. Arrays, maps and
+// ext are ordered by their encoding.
+func compareValues(a, b Value) int {
+	if a.kind != b.kind {
+		if a.kind < b.kind {
+			return -1
+		}
+		return 1
+	}
+
+	switch a.kind {
+	case KindNil:
+		return 0
+	case KindBool, KindUint:
+		return compareOrdered(a.n, b.n)
+	case KindInt:
+		return compareOrdered(int64(a.n), int64(b.n))
+	case KindFloat, KindDouble:
+		return compareOrdered(a.Float(), b.Float())
+	case KindStr:
+		return compareOrdered(a.s, b.s)
+	case KindBin:
+		return bytes.Compare(a.b, b.b)
+	}
+
+	var ab, bb bytes.Buffer
+	_ = NewEncoder(&ab).EncodeDynamic(a)
+	_ = NewEncoder(&bb).EncodeDynamic(b)
+	return bytes.Compare(ab.Bytes(), bb.Bytes())
+}
+
+func compareOrdered[T int64 | uint64 | float64 | string](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func canonicalBytes(b []byte) ([]byte, error) {
+	var v Value
+	if err := Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf).EncodeDynamic(canonicalValue(v)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// canonicalValue returns v with every item in its smallest format, integers
+// that fit in an int64 as int, floats as double, NaNs with a single bit
+// pattern, and map entries sorted by compareValues of their keys.
+func canonicalValue(v Value) Value {
+	switch v.kind {
+	case KindInt:
+		return IntValue(v.Int())
+	case KindUint:
+		if v.n <= math.MaxInt64 {
+			return IntValue(int64(v.n))
+		}
+		return UintValue(v.n)
+	case KindFloat, KindDouble:
+		f := v.Float()
+		if math.IsNaN(f) {
+			f = math.NaN()
+		}
+		return DoubleValue(f)
+	case KindArray:
+		elems := make([]Value, len(v.arr))
+		for i, e := range v.arr {
+			elems[i] = canonicalValue(e)
+		}
+		return ArrayValue(elems...)
+	case KindMap:
+		pairs := make([]ValuePair, len(v.dict))
+		for i, p := range v.dict {
+			pairs[i] = ValuePair{Key: canonicalValue(p.Key), Value: canonicalValue(p.Value)}
+		}
+		sort.SliceStable(pairs, func(i, j int) bool {
+			return compareValues(pairs[i].Key, pairs[j].Key) < 0
+		})
+		return MapValue(pairs...)
+	}
+	v.code, v.hasCode = 0, false
+	return v
+}
@@ -3,12 +3,13 @@ package msgpack
 import (
 	"bufio"
 	"bytes"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"math"
+	"reflect"
 	"sync"
+	"unicode/utf8"
 )
 
 const (
@@ -17,6 +18,19 @@ const (
 	maxMapSize      = 1e6
 )
 
+const (
+	strictFlag uint32 = 1 << iota
+	zeroCopyFlag
+	unsafeStringsFlag
+	looseInterfaceDecodingFlag
+	canonicalFlag
+	sortedMapKeysFlag
+)
+
+// ErrTrailingBytes is returned in strict mode when input remains after the
+// decoded value.
+var ErrTrailingBytes = errors.New("msgpack: trailing bytes after value")
+
 type bufReader interface {
 	io.Reader
 	io.ByteScanner
@@ -25,9 +39,19 @@ type bufReader interface {
 type Decoder struct {
 	r          io.Reader
 	s          io.ByteScanner
+	data       []byte
+	offset     int64
 	buf        []byte
 	rec        []byte
+	flags      uint32
+	dupKeys    DuplicateKeyPolicy
+	utf8       InvalidUTF8Policy
+	structTag  string
 	mapDecoder func(*Decoder) (interface{}, error)
+
+	// tokensOwed is the number of tokens NextToken still needs to finish
+	// the arrays and maps it has started.
+	tokensOwed int64
 }
 
 var decPool = sync.Pool{
@@ -49,13 +73,35 @@ func GetDecoder() *Decoder {
 func PutDecoder(dec *Decoder) {
 	dec.r = nil
 	dec.s = nil
+	dec.data = nil
+	dec.rec = nil
 	decPool.Put(dec)
 }
 
+// Unmarshal decodes the MessagePack-encoded data into v. Unlike a Decoder,
+// it expects data to hold exactly one value and reports ErrTrailingBytes if
+// anything follows it.
 func Unmarshal(data []byte, v interface{}) error {
 	dec := GetDecoder()
 
-	dec.Reset(bytes.NewReader(data))
+	dec.ResetBytes(data)
+	dec.Strict(true)
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+
+	PutDecoder(dec)
+	return nil
+}
+
+// UnmarshalNoCopy is like Unmarshal but decodes with UseZeroCopy enabled, so
+// []byte values in v alias data. See UseZeroCopy for the aliasing contract.
+func UnmarshalNoCopy(data []byte, v interface{}) error {
+	dec := GetDecoder()
+
+	dec.ResetBytes(data)
+	dec.Strict(true)
+	dec.UseZeroCopy(true)
 	if err := dec.Decode(v); err != nil {
 		return err
 	}
@@ -65,6 +111,34 @@ func Unmarshal(data []byte, v interface{}) error {
 }
 
 func (d *Decoder) Reset(r io.Reader) {
+	d.resetReader(r)
+	d.data = nil
+	d.resetOptions()
+}
+
+// ResetBytes is like Reset but reads from data directly, which lets
+// Buffered return the unread remainder of the slice.
+func (d *Decoder) ResetBytes(data []byte) {
+	d.resetBytes(data)
+	d.resetOptions()
+}
+
+// resetBytes switches the input to data, keeping the decoding options.
+func (d *Decoder) resetBytes(data []byte) {
+	d.resetReader(bytes.NewReader(data))
+	d.data = data
+}
+
+func (d *Decoder) resetOptions() {
+	d.flags = 0
+	d.dupKeys = DuplicateKeysLastWins
+	d.utf8 = InvalidUTF8Allow
+	d.structTag = ""
+	d.mapDecoder = nil
+	// d.dict = nil
+}
+
+func (d *Decoder) resetReader(r io.Reader) {
 	if br, ok := r.(bufReader); ok {
 		d.r = br
 		d.s = br
@@ -73,13 +147,120 @@ func (d *Decoder) Reset(r io.Reader) {
 		d.r = br
 		d.s = br
 	}
-	// d.flags = 0
-	// d.structTag = ""
-	// d.mapDecoder = nil
-	// d.dict = nil
+	d.offset = 0
+	d.tokensOwed = 0
+}
+
+// Strict makes Decode report ErrTrailingBytes when the input is not
+// exhausted after the decoded value.
+func (d *Decoder) Strict(on bool) {
+	d.setFlag(strictFlag, on)
+}
+
+// UseZeroCopy makes bin values decoded to []byte alias the slice passed to
+// ResetBytes instead of being copied. The decoded slices share memory with
+// the input, so the input must not be modified or reused while they are in
+// use. Their capacity is clipped, so appending to them never writes into the
+// input. It has no effect when decoding from an io.Reader.
+func (d *Decoder) UseZeroCopy(on bool) {
+	d.setFlag(zeroCopyFlag, on)
+}
+
+// UseUnsafeStrings extends UseZeroCopy to str values: decoded strings are
+// converted from the input without copying. Go strings are assumed to be
+// immutable, so modifying the input after decoding silently changes them.
+// It has no effect unless UseZeroCopy is enabled.
+func (d *Decoder) UseUnsafeStrings(on bool) {
+	d.setFlag(unsafeStringsFlag, on)
+}
+
+// UseLooseInterfaceDecoding makes DecodeInterface return int64 for every
+// integer and float64 for every float. Unsigned values above math.MaxInt64
+// are still returned as uint64.
+func (d *Decoder) UseLooseInterfaceDecoding(on bool) {
+	d.setFlag(looseInterfaceDecodingFlag, on)
+}
+
+// SetCustomStructTag makes struct fields take their names and options from
+// the given tag instead of the msgpack tag.
+func (d *Decoder) SetCustomStructTag(tag string) {
+	d.structTag = tag
+}
+
+func (d *Decoder) setFlag(flag uint32, on bool) {
+	if on {
+		d.flags |= flag
+	} else {
+		d.flags &= ^flag
+	}
+}
+
+// More reports whether there is another value to decode. When reading from
+// an io.Reader it blocks until a byte is available or the input ends.
+func (d *Decoder) More() bool {
+	if d.data != nil {
+		return d.offset < int64(len(d.data))
+	}
+	if _, err := d.s.ReadByte(); err != nil {
+		return false
+	}
+	return d.s.UnreadByte() == nil
+}
+
+// InputOffset returns the number of bytes consumed from the input so far.
+func (d *Decoder) InputOffset() int64 {
+	return d.offset
 }
 
+// Buffered returns a reader of the data that has been read ahead of the
+// current offset but not yet decoded. The reader is valid until the next
+// call to Decode.
+func (d *Decoder) Buffered() io.Reader {
+	if d.data != nil {
+		return bytes.NewReader(d.data[d.offset:])
+	}
+	if br, ok := d.r.(*bufio.Reader); ok {
+		b, _ := br.Peek(br.Buffered())
+		return bytes.NewReader(b)
+	}
+	return bytes.NewReader(nil)
+}
+
+// Decode reads the next MessagePack value from the input and stores it in v.
+// A Decoder can be called repeatedly to read a stream of back-to-back
+// values:
+//
+//	for {
+//		var v map[string]interface{}
+//		if err := dec.Decode(&v); err == io.EOF {
+//			break
+//		} else if err != nil {
+//			return err
+//		}
+//		...
+//	}
+//
+// Decode returns io.EOF only when the input ends cleanly before the first
+// byte of a value, and io.ErrUnexpectedEOF when it ends in the middle of one.
 func (d *Decoder) Decode(v interface{}) error {
+	start := d.offset
+	decode := d.decode
+	if d.flags&(canonicalFlag|sortedMapKeysFlag) != 0 {
+		decode = d.decodeCanonical
+	}
+	if err := decode(v); err != nil {
+		if err == io.EOF && d.offset != start {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if d.flags&strictFlag != 0 {
+		return d.checkTrailing()
+	}
+	return nil
+}
+
+func (d *Decoder) decode(v interface{}) error {
 	switch v := v.(type) {
 	case *map[string]interface{}:
 		m, err := d.DecodeMap()
@@ -88,9 +269,47 @@ func (d *Decoder) Decode(v interface{}) error {
 		}
 		*v = m
 		return nil
-	default:
-		return errors.New(fmt.Sprintf("Not Support: %T", v))
+	case *[]byte:
+		b, err := d.DecodeBytes()
+		if err != nil {
+			return err
+		}
+		*v = b
+		return nil
+	case *interface{}:
+		i, err := d.DecodeInterface()
+		if err != nil {
+			return err
+		}
+		*v = i
+		return nil
+	}
+
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("msgpack: Decode(non-pointer %T)", v)
+	}
+	return d.DecodeValue(rv.Elem())
+}
+
+func (d *Decoder) checkTrailing() error {
+	if d.data != nil {
+		if n := int64(len(d.data)) - d.offset; n > 0 {
+			return fmt.Errorf("%w: %d bytes at offset %d", ErrTrailingBytes, n, d.offset)
+		}
+		return nil
+	}
+	_, err := d.s.ReadByte()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
 	}
+	if err := d.s.UnreadByte(); err != nil {
+		return err
+	}
+	return fmt.Errorf("%w at offset %d", ErrTrailingBytes, d.offset)
 }
 
 //--------------------------------------------------
@@ -108,7 +327,15 @@ func (d *Decoder) DecodeMap() (map[string]interface{}, error) {
 	m := make(map[string]interface{}, min(n, maxMapSize))
 
 	for i := 0; i < n; i++ {
-		mk, err := d.DecodeString()
+		off := d.offset
+		c, err := d.readCode()
+		if err != nil {
+			return nil, err
+		}
+		if !IsString(c) && c != Nil {
+			return nil, unexpectedCodeError{code: c, hint: "string map key"}
+		}
+		mk, err := d.string(c)
 		if err != nil {
 			return nil, err
 		}
@@ -116,6 +343,15 @@ func (d *Decoder) DecodeMap() (map[string]interface{}, error) {
 		if err != nil {
 			return nil, err
 		}
+		if d.dupKeys != DuplicateKeysLastWins {
+			if _, ok := m[mk]; ok {
+				if keep, err := d.keepDuplicate(mk, off); err != nil {
+					return nil, err
+				} else if !keep {
+					continue
+				}
+			}
+		}
 		m[mk] = mv
 	}
 
@@ -133,15 +369,26 @@ func (d *Decoder) DecodeMapLen() (int, error) {
 func (d *Decoder) readCode() (byte, error) {
 	c, err := d.s.ReadByte()
 	if err != nil {
-		fmt.Println("readCode:", err)
 		return 0, err
 	}
+	d.offset++
 	if d.rec != nil {
 		d.rec = append(d.rec, c)
 	}
 	return c, nil
 }
 
+func (d *Decoder) unreadByte() error {
+	if err := d.s.UnreadByte(); err != nil {
+		return err
+	}
+	d.offset--
+	if d.rec != nil {
+		d.rec = d.rec[:len(d.rec)-1]
+	}
+	return nil
+}
+
 func (d *Decoder) mapLen(c byte) (int, error) {
 	if c == Nil {
 		return -1, nil
@@ -155,7 +402,10 @@ func (d *Decoder) mapLen(c byte) (int, error) {
 	}
 	if c == Map32 {
 		size, err := d.uint32()
-		return int(size), err
+		if err != nil {
+			return 0, err
+		}
+		return length32(size)
 	}
 	return 0, unexpectedCodeError{code: c, hint: "map length"}
 }
@@ -165,7 +415,6 @@ func (d *Decoder) mapLen(c byte) (int, error) {
 func (d *Decoder) DecodeString() (string, error) {
 	c, err := d.readCode()
 	if err != nil {
-		fmt.Println("DecodeString:", err)
 		return "", err
 	}
 	return d.string(c)
@@ -181,7 +430,6 @@ func (d *Decoder) string(c byte) (string, error) {
 
 func (d *Decoder) bytesLen(c byte) (int, error) {
 	if c == Nil {
-		fmt.Println("bytesLen:", c)
 		return -1, nil
 	}
 
@@ -198,7 +446,10 @@ func (d *Decoder) bytesLen(c byte) (int, error) {
 		return int(n), err
 	case Str32, Bin32:
 		n, err := d.uint32()
-		return int(n), err
+		if err != nil {
+			return 0, err
+		}
+		return length32(n)
 	}
 
 	return 0, fmt.Errorf("msgpack: invalid code=%x decoding string/bytes length", c)
@@ -208,12 +459,158 @@ func (d *Decoder) stringWithLen(n int) (string, error) {
 	if n <= 0 {
 		return "", nil
 	}
+	off := d.offset
+	var str string
+	if d.noCopy() && d.flags&unsafeStringsFlag != 0 {
+		b, err := d.sliceN(n)
+		if err != nil {
+			return "", err
+		}
+		str = bytesToString(b)
+	} else {
+		b, err := d.readN(n)
+		if err != nil {
+			return "", err
+		}
+		str = string(b)
+	}
+	return d.checkUTF8(str, off)
+}
+
+// SetInvalidUTF8Policy sets how str values that are not valid UTF-8 are
+// decoded. The default is InvalidUTF8Allow.
+func (d *Decoder) SetInvalidUTF8Policy(p InvalidUTF8Policy) {
+	d.utf8 = p
+}
+
+func (d *Decoder) checkUTF8(s string, offset int64) (string, error) {
+	if d.utf8 == InvalidUTF8Allow || d.utf8 == InvalidUTF8AsBin || utf8.ValidString(s) {
+		return s, nil
+	}
+	if d.utf8 == InvalidUTF8Replace {
+		return replaceInvalidUTF8(s), nil
+	}
+	return "", fmt.Errorf("%w at offset %d", ErrInvalidUTF8, offset)
+}
+
+//--------------------------------------------------
+
+func (d *Decoder) DecodeBytes() ([]byte, error) {
+	c, err := d.readCode()
+	if err != nil {
+		return nil, err
+	}
+	return d.bytes(c)
+}
+
+func (d *Decoder) bytes(c byte) ([]byte, error) {
+	n, err := d.bytesLen(c)
+	if err != nil {
+		return nil, err
+	}
+	if n == -1 {
+		return nil, nil
+	}
+	if d.noCopy() {
+		return d.sliceN(n)
+	}
 	b, err := d.readN(n)
-	return string(b), err
+	if err != nil {
+		return nil, err
+	}
+	return append(make([]byte, 0, n), b...), nil
 }
 
 //--------------------------------------------------
 
+// Skip reads and discards the next value, including everything nested in
+// it.
+func (d *Decoder) Skip() error {
+	start := d.offset
+	_, _, err := d.skipValues(1)
+	if err == io.EOF && d.offset != start {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// skipValues skips n values, one item at a time. If it fails, it returns
+// the number of values left to skip and the input offset where the item it
+// failed in starts, so that skipping can be resumed from there. n is an
+// int64 so that adding container lengths from the input cannot overflow.
+func (d *Decoder) skipValues(n int64) (int64, int64, error) {
+	for ; n > 0; n-- {
+		start := d.offset
+		fail := func(err error) (int64, int64, error) {
+			return n, start, err
+		}
+
+		c, err := d.readCode()
+		if err != nil {
+			return fail(err)
+		}
+
+		if IsFixedNum(c) {
+			continue
+		}
+		if IsFixedMap(c) || c == Map16 || c == Map32 {
+			l, err := d.mapLen(c)
+			if err != nil {
+				return fail(err)
+			}
+			n += 2 * int64(l)
+			continue
+		}
+		if IsFixedArray(c) || c == Array16 || c == Array32 {
+			l, err := d.arrayLen(c)
+			if err != nil {
+				return fail(err)
+			}
+			n += int64(l)
+			continue
+		}
+		if IsString(c) || IsBin(c) {
+			l, err := d.bytesLen(c)
+			if err != nil {
+				return fail(err)
+			}
+			if err := d.skipN(l); err != nil {
+				return fail(err)
+			}
+			continue
+		}
+		if IsExt(c) {
+			l, err := d.extLen(c)
+			if err != nil {
+				return fail(err)
+			}
+			if err := d.skipN(l + 1); err != nil {
+				return fail(err)
+			}
+			continue
+		}
+
+		var l int
+		switch c {
+		case Nil, False, True:
+		case Uint8, Int8:
+			l = 1
+		case Uint16, Int16:
+			l = 2
+		case Float, Uint32, Int32:
+			l = 4
+		case Double, Uint64, Int64:
+			l = 8
+		default:
+			return fail(unexpectedCodeError{code: c, hint: "value to skip"})
+		}
+		if err := d.skipN(l); err != nil {
+			return fail(err)
+		}
+	}
+	return 0, d.offset, nil
+}
+
 func (d *Decoder) DecodeInterface() (interface{}, error) {
 	c, err := d.readCode()
 	if err != nil {
@@ -221,10 +618,10 @@ func (d *Decoder) DecodeInterface() (interface{}, error) {
 	}
 
 	if IsFixedNum(c) {
-		return int8(c), nil
+		return d.interfaceNumber(c)
 	}
 	if IsFixedMap(c) {
-		err = d.s.UnreadByte()
+		err = d.unreadByte()
 		if err != nil {
 			return nil, err
 		}
@@ -242,23 +639,64 @@ func (d *Decoder) DecodeInterface() (interface{}, error) {
 		return nil, nil
 	case False, True:
 		return d.bool(c)
-	case Double:
-		return d.float64(c)
+	case Float, Double, Uint8, Uint16, Uint32, Uint64, Int8, Int16, Int32, Int64:
+		return d.interfaceNumber(c)
 	case Str8, Str16, Str32:
 		return d.string(c)
+	case Bin8, Bin16, Bin32:
+		return d.bytes(c)
+	case FixExt1, FixExt2, FixExt4, FixExt8, FixExt16, Ext8, Ext16, Ext32:
+		return d.ext(c)
+	case Array16, Array32:
+		return d.decodeSlice(c)
 	case Map16, Map32:
-		err = d.s.UnreadByte()
+		err = d.unreadByte()
 		if err != nil {
 			return nil, err
 		}
 		return d.decodeMapDefault()
-	default:
-		fmt.Printf("Not support 0x%s\n", hex.EncodeToString([]byte{c}))
 	}
 
 	return 0, fmt.Errorf("msgpack: unknown code %x decoding interface{}", c)
 }
 
+// interfaceNumber decodes a number for DecodeInterface: int64 for signed
+// integers and fixints, uint64 for unsigned integers, float32 and float64
+// for floats. In loose mode every integer that fits is returned as int64 and
+// every float as float64.
+func (d *Decoder) interfaceNumber(c byte) (interface{}, error) {
+	n, err := d.number(c)
+	if err != nil || d.flags&looseInterfaceDecodingFlag == 0 {
+		return n, err
+	}
+	switch n := n.(type) {
+	case uint64:
+		if n <= math.MaxInt64 {
+			return int64(n), nil
+		}
+	case float32:
+		return float64(n), nil
+	}
+	return n, nil
+}
+
+func (d *Decoder) number(c byte) (interface{}, error) {
+	if IsFixedNum(c) {
+		return int64(int8(c)), nil
+	}
+	switch c {
+	case Float:
+		return d.float32(c)
+	case Double:
+		return d.float64(c)
+	case Uint8, Uint16, Uint32, Uint64:
+		return d.uint(c)
+	case Int8, Int16, Int32, Int64:
+		return d.int(c)
+	}
+	return nil, fmt.Errorf("msgpack: invalid code=%x decoding number", c)
+}
+
 func (d *Decoder) int(c byte) (int64, error) {
 	if c == Nil {
 		return 0, nil
@@ -285,13 +723,46 @@ func (d *Decoder) int(c byte) (int64, error) {
 	case Int32:
 		n, err := d.uint32()
 		return int64(int32(n)), err
-	case Uint64, Int64:
+	case Uint64:
+		n, err := d.uint64()
+		if err == nil && n > math.MaxInt64 {
+			return 0, fmt.Errorf("msgpack: value %d overflows int64", n)
+		}
+		return int64(n), err
+	case Int64:
 		n, err := d.uint64()
 		return int64(n), err
 	}
 	return 0, fmt.Errorf("msgpack: invalid code=%x decoding int64", c)
 }
 
+func (d *Decoder) uint(c byte) (uint64, error) {
+	switch c {
+	case Nil:
+		return 0, nil
+	case Uint8:
+		n, err := d.uint8()
+		return uint64(n), err
+	case Uint16:
+		n, err := d.uint16()
+		return uint64(n), err
+	case Uint32:
+		n, err := d.uint32()
+		return uint64(n), err
+	case Uint64:
+		return d.uint64()
+	}
+
+	n, err := d.int(c)
+	if err != nil {
+		return 0, fmt.Errorf("msgpack: invalid code=%x decoding uint64", c)
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("msgpack: value %d overflows uint64", n)
+	}
+	return uint64(n), nil
+}
+
 func (d *Decoder) int8() (int8, error) {
 	n, err := d.uint8()
 	return int8(n), err
@@ -306,6 +777,10 @@ func (d *Decoder) float32(c byte) (float32, error) {
 		return math.Float32frombits(n), nil
 	}
 
+	if c == Uint64 {
+		n, err := d.uint64()
+		return float32(n), err
+	}
 	n, err := d.int(c)
 	if err != nil {
 		return 0, fmt.Errorf("msgpack: invalid code=%x decoding float32", c)
@@ -329,9 +804,13 @@ func (d *Decoder) float64(c byte) (float64, error) {
 		return math.Float64frombits(n), nil
 	}
 
+	if c == Uint64 {
+		n, err := d.uint64()
+		return float64(n), err
+	}
 	n, err := d.int(c)
 	if err != nil {
-		return 0, fmt.Errorf("msgpack: invalid code=%x decoding float32", c)
+		return 0, fmt.Errorf("msgpack: invalid code=%x decoding float64", c)
 	}
 	return float64(n), nil
 }
@@ -340,7 +819,56 @@ func (d *Decoder) decodeMapDefault() (interface{}, error) {
 	if d.mapDecoder != nil {
 		return d.mapDecoder(d)
 	}
-	return d.DecodeMap()
+	return d.decodeInterfaceMap()
+}
+
+// decodeInterfaceMap decodes a map as map[string]interface{}, switching to
+// map[interface{}]interface{} if it meets a key that is not a string.
+func (d *Decoder) decodeInterfaceMap() (interface{}, error) {
+	n, err := d.DecodeMapLen()
+	if err != nil {
+		return nil, err
+	}
+
+	if n == -1 {
+		return nil, nil
+	}
+
+	m := make(map[string]interface{}, min(n, maxMapSize))
+
+	for i := 0; i < n; i++ {
+		off := d.offset
+		c, err := d.readCode()
+		if err != nil {
+			return nil, err
+		}
+		if !IsString(c) {
+			if err := d.unreadByte(); err != nil {
+				return nil, err
+			}
+			return d.decodeUntypedMapRest(m, n-i)
+		}
+		mk, err := d.string(c)
+		if err != nil {
+			return nil, err
+		}
+		mv, err := d.DecodeInterface()
+		if err != nil {
+			return nil, err
+		}
+		if d.dupKeys != DuplicateKeysLastWins {
+			if _, ok := m[mk]; ok {
+				if keep, err := d.keepDuplicate(mk, off); err != nil {
+					return nil, err
+				} else if !keep {
+					continue
+				}
+			}
+		}
+		m[mk] = mv
+	}
+
+	return m, nil
 }
 
 func (d *Decoder) decodeSlice(c byte) ([]interface{}, error) {
@@ -376,13 +904,111 @@ func (d *Decoder) arrayLen(c byte) (int, error) {
 		return int(n), err
 	case Array32:
 		n, err := d.uint32()
-		return int(n), err
+		if err != nil {
+			return 0, err
+		}
+		return length32(n)
 	}
 	return 0, fmt.Errorf("msgpack: invalid code=%x decoding array length", c)
 }
 
 //--------------------------------------------------
 
+// DecodeNil reads a nil value and fails if the next value is anything else.
+func (d *Decoder) DecodeNil() error {
+	c, err := d.readCode()
+	if err != nil {
+		return err
+	}
+	if c != Nil {
+		return unexpectedCodeError{code: c, hint: "nil"}
+	}
+	return nil
+}
+
+// DecodeInt64 reads any integer that fits in an int64. Nil decodes as 0.
+func (d *Decoder) DecodeInt64() (int64, error) {
+	c, err := d.readCode()
+	if err != nil {
+		return 0, err
+	}
+	return d.int(c)
+}
+
+// DecodeUint64 reads any non-negative integer. Nil decodes as 0.
+func (d *Decoder) DecodeUint64() (uint64, error) {
+	c, err := d.readCode()
+	if err != nil {
+		return 0, err
+	}
+	return d.uint(c)
+}
+
+// DecodeFloat32 reads a float, or an integer converted to float32.
+func (d *Decoder) DecodeFloat32() (float32, error) {
+	c, err := d.readCode()
+	if err != nil {
+		return 0, err
+	}
+	return d.float32(c)
+}
+
+// DecodeFloat64 reads a float or double, or an integer converted to
+// float64.
+func (d *Decoder) DecodeFloat64() (float64, error) {
+	c, err := d.readCode()
+	if err != nil {
+		return 0, err
+	}
+	return d.float64(c)
+}
+
+// DecodeArrayLen reads an array header and returns the number of elements
+// that follow, or -1 for nil.
+func (d *Decoder) DecodeArrayLen() (int, error) {
+	c, err := d.readCode()
+	if err != nil {
+		return 0, err
+	}
+	return d.arrayLen(c)
+}
+
+// DecodeBytesLen reads a str or bin header and returns the number of bytes
+// that follow, or -1 for nil. The bytes can then be read with ReadFull.
+func (d *Decoder) DecodeBytesLen() (int, error) {
+	c, err := d.readCode()
+	if err != nil {
+		return 0, err
+	}
+	return d.bytesLen(c)
+}
+
+// DecodeExtHeader reads an ext header and returns its type and the length
+// of the payload that follows. The payload can then be read with ReadFull.
+func (d *Decoder) DecodeExtHeader() (typ int8, length int, err error) {
+	c, err := d.readCode()
+	if err != nil {
+		return 0, 0, err
+	}
+	return d.extHeader(c)
+}
+
+// ReadFull reads exactly len(b) bytes of raw input into b, for payloads
+// whose header was read with DecodeBytesLen or DecodeExtHeader.
+func (d *Decoder) ReadFull(b []byte) error {
+	n, err := io.ReadFull(d.r, b)
+	d.offset += int64(n)
+	if err != nil {
+		return err
+	}
+	if d.rec != nil {
+		d.rec = append(d.rec, b...)
+	}
+	return nil
+}
+
+//--------------------------------------------------
+
 func (d *Decoder) DecodeBool() (bool, error) {
 	c, err := d.readCode()
 	if err != nil {
@@ -406,6 +1032,20 @@ func (d *Decoder) bool(c byte) (bool, error) {
 
 //--------------------------------------------------
 
+// PeekCode returns the format code of the next value without consuming it.
+func (d *Decoder) PeekCode() (byte, error) {
+	c, err := d.readCode()
+	if err != nil {
+		return 0, err
+	}
+	return c, d.unreadByte()
+}
+
+func (d *Decoder) hasNilCode() bool {
+	c, err := d.PeekCode()
+	return err == nil && c == Nil
+}
+
 func (d *Decoder) uint8() (uint8, error) {
 	c, err := d.readCode()
 	if err != nil {
@@ -422,6 +1062,15 @@ func (d *Decoder) uint16() (uint16, error) {
 	return (uint16(b[0]) << 8) | uint16(b[1]), nil
 }
 
+// length32 converts a 32-bit length from the input to an int, failing
+// where int is too small to hold it.
+func length32(n uint32) (int, error) {
+	if uint64(n) > math.MaxInt {
+		return 0, fmt.Errorf("msgpack: length %d does not fit in int", n)
+	}
+	return int(n), nil
+}
+
 func (d *Decoder) uint32() (uint32, error) {
 	b, err := d.readN(4)
 	if err != nil {
@@ -456,8 +1105,52 @@ func (d *Decoder) readN(n int) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	d.offset += int64(n)
 	if d.rec != nil {
 		d.rec = append(d.rec, d.buf...)
 	}
 	return d.buf, nil
 }
+
+// skipN discards the next n bytes of the input.
+func (d *Decoder) skipN(n int) error {
+	if n <= 0 {
+		return nil
+	}
+	if d.data != nil {
+		_, err := d.sliceN(n)
+		return err
+	}
+	if d.rec != nil {
+		_, err := d.readN(n)
+		return err
+	}
+	m, err := io.CopyN(io.Discard, d.r, int64(n))
+	d.offset += m
+	if err == io.EOF && m > 0 {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (d *Decoder) noCopy() bool {
+	return d.data != nil && d.flags&zeroCopyFlag != 0
+}
+
+// sliceN returns the next n bytes as a subslice of the input passed to
+// ResetBytes and advances past them.
+func (d *Decoder) sliceN(n int) ([]byte, error) {
+	end := d.offset + int64(n)
+	if end > int64(len(d.data)) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if _, err := d.r.(io.Seeker).Seek(int64(n), io.SeekCurrent); err != nil {
+		return nil, err
+	}
+	b := d.data[d.offset:end:end]
+	d.offset = end
+	if d.rec != nil {
+		d.rec = append(d.rec, b...)
+	}
+	return b, nil
+}
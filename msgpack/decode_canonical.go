@@ -0,0 +1,272 @@
+package msgpack
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// ErrNotCanonical is returned under RequireCanonical and
+// RequireSortedMapKeys for input that is not in canonical form.
+var ErrNotCanonical = errors.New("msgpack: not canonical")
+
+// RequireCanonical makes Decode reject values that are not encoded the way
+// the Encoder would encode them: integers, and str, bin, ext, array and map
+// headers, must use the smallest format that holds them. Errors wrap
+// ErrNotCanonical and give the offset of the offending item.
+func (d *Decoder) RequireCanonical(on bool) {
+	d.setFlag(canonicalFlag, on)
+}
+
+// RequireSortedMapKeys makes Decode reject maps whose keys are not in
+// ascending order: by value for keys of the same type, as the Encoder sorts
+// Go maps, and nil, bool, int, uint, float, str, bin, ext, array, map
+// between types.
+func (d *Decoder) RequireSortedMapKeys(on bool) {
+	d.setFlag(sortedMapKeysFlag, on)
+}
+
+// decodeCanonical checks the next value for canonical form, then rewinds
+// and decodes it into v.
+func (d *Decoder) decodeCanonical(v interface{}) error {
+	start := d.offset
+	if d.data != nil {
+		if err := d.checkCanonical(); err != nil {
+			return err
+		}
+		if _, err := d.r.(io.Seeker).Seek(start, io.SeekStart); err != nil {
+			return err
+		}
+		d.offset = start
+		return d.decode(v)
+	}
+
+	d.rec = make([]byte, 0, 64)
+	err := d.checkCanonical()
+	rec := d.rec
+	d.rec = nil
+	if err != nil {
+		return err
+	}
+
+	r, s := d.r, d.s
+	br := bytes.NewReader(rec)
+	d.r, d.s = br, br
+	d.offset = start
+	err = d.decode(v)
+	d.r, d.s = r, s
+	return err
+}
+
+// checkCanonical reads the next value, checking it against the canonical
+// options in effect.
+func (d *Decoder) checkCanonical() error {
+	off := d.offset
+	c, err := d.readCode()
+	if err != nil {
+		return err
+	}
+	headers := d.flags&canonicalFlag != 0
+
+	switch {
+	case IsFixedNum(c) || c == Nil || c == False || c == True:
+		return nil
+	case c == Float:
+		return d.skipN(4)
+	case c == Double:
+		return d.skipN(8)
+	case c == Uint8 || c == Uint16 || c == Uint32 || c == Uint64:
+		n, err := d.uint(c)
+		if err != nil {
+			return err
+		}
+		if headers && c != uintCode(n) {
+			return notCanonicalError(off, "integer %d", n)
+		}
+		return nil
+	case c == Int8 || c == Int16 || c == Int32 || c == Int64:
+		n, err := d.int(c)
+		if err != nil {
+			return err
+		}
+		if headers && c != intCode(n) {
+			return notCanonicalError(off, "integer %d", n)
+		}
+		return nil
+	case IsString(c) || IsBin(c):
+		l, err := d.bytesLen(c)
+		if err != nil {
+			return err
+		}
+		want := strCode(l)
+		if IsBin(c) {
+			want = binCode(l)
+		}
+		if headers && c != want {
+			return notCanonicalError(off, "header for %d bytes", l)
+		}
+		return d.skipN(l)
+	case IsExt(c):
+		l, err := d.extLen(c)
+		if err != nil {
+			return err
+		}
+		if headers && c != extCode(l) {
+			return notCanonicalError(off, "ext header for %d bytes", l)
+		}
+		return d.skipN(l + 1)
+	case IsFixedArray(c) || c == Array16 || c == Array32:
+		n, err := d.arrayLen(c)
+		if err != nil {
+			return err
+		}
+		if headers && c != containerCode(n, FixedArrayLow, Array16, Array32) {
+			return notCanonicalError(off, "header for array of %d", n)
+		}
+		for i := 0; i < n; i++ {
+			if err := d.checkCanonical(); err != nil {
+				return err
+			}
+		}
+		return nil
+	case IsFixedMap(c) || c == Map16 || c == Map32:
+		n, err := d.mapLen(c)
+		if err != nil {
+			return err
+		}
+		if headers && c != containerCode(n, FixedMapLow, Map16, Map32) {
+			return notCanonicalError(off, "header for map of %d", n)
+		}
+		return d.checkCanonicalMap(n)
+	}
+	return unexpectedCodeError{code: c, hint: "value"}
+}
+
+func (d *Decoder) checkCanonicalMap(n int) error {
+	sorted := d.flags&sortedMapKeysFlag != 0
+	var prev Value
+	for i := 0; i < n; i++ {
+		off := d.offset
+		if err := d.checkCanonical(); err != nil {
+			return err
+		}
+		if sorted {
+			key, err := d.recordedValue(off)
+			if err != nil {
+				return err
+			}
+			if i > 0 && compareValues(prev, key) >= 0 {
+				return notCanonicalError(off, "map key order")
+			}
+			prev = key
+		}
+		if err := d.checkCanonical(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordedValue decodes the canonical form of the value read since off,
+// from the input slice or the bytes recorded by decodeCanonical.
+func (d *Decoder) recordedValue(off int64) (Value, error) {
+	var b []byte
+	if d.data != nil {
+		b = d.data[off:d.offset]
+	} else {
+		b = d.rec[int64(len(d.rec))-(d.offset-off):]
+	}
+	var v Value
+	if err := Unmarshal(b, &v); err != nil {
+		return Value{}, err
+	}
+	return canonicalValue(v), nil
+}
+
+func notCanonicalError(off int64, format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s at offset %d", ErrNotCanonical, fmt.Sprintf(format, args...), off)
+}
+
+// intCode returns the code EncodeInt uses for n.
+func intCode(n int64) byte {
+	switch {
+	case n >= 0:
+		return uintCode(uint64(n))
+	case n >= int64(int8(NegFixedNumLow)):
+		return byte(n)
+	case n >= math.MinInt8:
+		return Int8
+	case n >= math.MinInt16:
+		return Int16
+	case n >= math.MinInt32:
+		return Int32
+	}
+	return Int64
+}
+
+// uintCode returns the code EncodeUint uses for n.
+func uintCode(n uint64) byte {
+	switch {
+	case n <= math.MaxInt8:
+		return byte(n)
+	case n <= math.MaxUint8:
+		return Uint8
+	case n <= math.MaxUint16:
+		return Uint16
+	case n <= math.MaxUint32:
+		return Uint32
+	}
+	return Uint64
+}
+
+// strCode returns the code EncodeStringLen uses for l.
+func strCode(l int) byte {
+	switch {
+	case l < 32:
+		return FixedStrLow | byte(l)
+	case l < 256:
+		return Str8
+	case l <= math.MaxUint16:
+		return Str16
+	}
+	return Str32
+}
+
+// binCode returns the code EncodeBinLen uses for l.
+func binCode(l int) byte {
+	switch {
+	case l < 256:
+		return Bin8
+	case l <= math.MaxUint16:
+		return Bin16
+	}
+	return Bin32
+}
+
+// extCode returns the code EncodeExtHeader uses for l.
+func extCode(l int) byte {
+	if c := fixExtCode(l); c != 0 {
+		return c
+	}
+	switch {
+	case l <= math.MaxUint8:
+		return Ext8
+	case l <= math.MaxUint16:
+		return Ext16
+	}
+	return Ext32
+}
+
+// containerCode returns the code EncodeArrayLen or EncodeMapLen uses for
+// n, given the family's fix, 16-bit and 32-bit codes.
+func containerCode(n int, fix, c16, c32 byte) byte {
+	switch {
+	case n < 16:
+		return fix | byte(n)
+	case n <= math.MaxUint16:
+		return c16
+	}
+	return c32
+}
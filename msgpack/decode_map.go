@@ -0,0 +1,318 @@
+package msgpack
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+)
+
+// KeyValue is a single entry of an OrderedMap.
+type KeyValue struct {
+	Key   interface{}
+	Value interface{}
+}
+
+// OrderedMap is a map held as a slice of its entries. OrderedMapDecoder
+// produces it in encoded order and the Encoder writes it back in slice
+// order, so documents decoded this way keep their key order on re-encoding.
+type OrderedMap []KeyValue
+
+// Get returns the value of the last entry with the given key, the one
+// decoding into a Go map keeps by default. Bin keys, decoded as []byte, are
+// compared by content.
+func (m OrderedMap) Get(key interface{}) (interface{}, bool) {
+	for i := len(m) - 1; i >= 0; i-- {
+		if keyEqual(m[i].Key, key) {
+			return m[i].Value, true
+		}
+	}
+	return nil, false
+}
+
+// keyEqual compares map keys without panicking on uncomparable ones.
+func keyEqual(a, b interface{}) bool {
+	if ab, ok := a.([]byte); ok {
+		bb, ok := b.([]byte)
+		return ok && bytes.Equal(ab, bb)
+	}
+	if a != nil && !isComparable(a) {
+		return false
+	}
+	return a == b
+}
+
+// DuplicateKeyPolicy selects what happens when a map key occurs more than
+// once in the input.
+type DuplicateKeyPolicy int
+
+const (
+	// DuplicateKeysLastWins keeps the value of the last occurrence.
+	DuplicateKeysLastWins DuplicateKeyPolicy = iota
+	// DuplicateKeysFirstWins keeps the value of the first occurrence.
+	DuplicateKeysFirstWins
+	// DuplicateKeysReject fails with a *DuplicateKeyError.
+	DuplicateKeysReject
+)
+
+// DuplicateKeyError reports a map key that occurs more than once.
+type DuplicateKeyError struct {
+	Key interface{}
+	// Offset is the input offset of the repeated occurrence.
+	Offset int64
+}
+
+func (err *DuplicateKeyError) Error() string {
+	return fmt.Sprintf("msgpack: duplicate map key %v at offset %d", err.Key, err.Offset)
+}
+
+// SetDuplicateKeyPolicy sets how maps with a repeated key are decoded. The
+// default is DuplicateKeysLastWins. OrderedMap keeps every entry under
+// DuplicateKeysLastWins, as the order of entries is what it preserves.
+func (d *Decoder) SetDuplicateKeyPolicy(p DuplicateKeyPolicy) {
+	d.dupKeys = p
+}
+
+// keepDuplicate is called for a key that was already decoded into the
+// current map, found again at offset. It reports whether the new value
+// replaces the old one.
+func (d *Decoder) keepDuplicate(key interface{}, offset int64) (bool, error) {
+	switch d.dupKeys {
+	case DuplicateKeysFirstWins:
+		return false, nil
+	case DuplicateKeysReject:
+		return false, &DuplicateKeyError{Key: key, Offset: offset}
+	}
+	return true, nil
+}
+
+// SetMapDecoder sets the function DecodeInterface uses to decode maps,
+// including nested ones. StringMapDecoder, UntypedMapDecoder and
+// OrderedMapDecoder cover the common representations; nil restores the
+// default.
+func (d *Decoder) SetMapDecoder(fn func(*Decoder) (interface{}, error)) {
+	d.mapDecoder = fn
+}
+
+// StringMapDecoder decodes maps as map[string]interface{}.
+func StringMapDecoder(d *Decoder) (interface{}, error) {
+	return d.DecodeMap()
+}
+
+// UntypedMapDecoder decodes maps as map[interface{}]interface{}.
+func UntypedMapDecoder(d *Decoder) (interface{}, error) {
+	return d.DecodeUntypedMap()
+}
+
+// OrderedMapDecoder decodes maps as OrderedMap.
+func OrderedMapDecoder(d *Decoder) (interface{}, error) {
+	return d.DecodeOrderedMap()
+}
+
+func (d *Decoder) DecodeUntypedMap() (map[interface{}]interface{}, error) {
+	n, err := d.DecodeMapLen()
+	if err != nil {
+		return nil, err
+	}
+
+	if n == -1 {
+		return nil, nil
+	}
+
+	m := make(map[interface{}]interface{}, min(n, maxMapSize))
+	if err := d.decodeUntypedMapEntries(m, n); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// decodeUntypedMapRest decodes the remaining n entries of a map that was
+// started as a map[string]interface{} into a map[interface{}]interface{}.
+func (d *Decoder) decodeUntypedMapRest(sm map[string]interface{}, n int) (interface{}, error) {
+	m := make(map[interface{}]interface{}, len(sm)+min(n, maxMapSize))
+	for k, v := range sm {
+		m[k] = v
+	}
+	if err := d.decodeUntypedMapEntries(m, n); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (d *Decoder) decodeUntypedMapEntries(m map[interface{}]interface{}, n int) error {
+	// Duplicates are found by normalized key, so that 1 encoded as fixint
+	// and as uint8 count as the same key although they decode to int64 and
+	// uint64.
+	var seen map[interface{}]struct{}
+	if d.dupKeys != DuplicateKeysLastWins {
+		seen = make(map[interface{}]struct{}, len(m)+min(n, maxMapSize))
+		for k := range m {
+			seen[normalizeKey(k)] = struct{}{}
+		}
+	}
+
+	for i := 0; i < n; i++ {
+		off := d.offset
+		mk, err := d.decodeMapKey()
+		if err != nil {
+			return err
+		}
+		mv, err := d.DecodeInterface()
+		if err != nil {
+			return err
+		}
+		if seen != nil {
+			nk := normalizeKey(mk)
+			if _, ok := seen[nk]; ok {
+				if _, err := d.keepDuplicate(mk, off); err != nil {
+					return err
+				}
+				continue
+			}
+			seen[nk] = struct{}{}
+		}
+		m[mk] = mv
+	}
+	return nil
+}
+
+func (d *Decoder) DecodeOrderedMap() (OrderedMap, error) {
+	n, err := d.DecodeMapLen()
+	if err != nil {
+		return nil, err
+	}
+
+	if n == -1 {
+		return nil, nil
+	}
+
+	m := make(OrderedMap, 0, min(n, maxMapSize))
+
+	var seen map[interface{}]struct{}
+	if d.dupKeys != DuplicateKeysLastWins {
+		seen = make(map[interface{}]struct{}, min(n, maxMapSize))
+	}
+
+	for i := 0; i < n; i++ {
+		off := d.offset
+		mk, err := d.DecodeInterface()
+		if err != nil {
+			return nil, err
+		}
+		mv, err := d.DecodeInterface()
+		if err != nil {
+			return nil, err
+		}
+		if nk := normalizeKey(mk); seen != nil && (nk == nil || isComparable(nk)) {
+			if _, ok := seen[nk]; ok {
+				if _, err := d.keepDuplicate(mk, off); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			seen[nk] = struct{}{}
+		}
+		m = append(m, KeyValue{Key: mk, Value: mv})
+	}
+
+	return m, nil
+}
+
+// decodeStructValue decodes a map into the fields of v. Keys that match no
+// field go to the struct's inline map if it has one and are skipped
+// otherwise.
+func decodeStructValue(d *Decoder, v reflect.Value) error {
+	n, err := d.DecodeMapLen()
+	if err != nil {
+		return err
+	}
+	if n == -1 {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+
+	fs := getStructFields(v.Type(), d.structTag)
+	var seen map[string]struct{}
+	if d.dupKeys != DuplicateKeysLastWins {
+		seen = make(map[string]struct{}, min(n, len(fs.list)))
+	}
+
+	for i := 0; i < n; i++ {
+		off := d.offset
+		name, err := d.DecodeString()
+		if err != nil {
+			return err
+		}
+
+		if seen != nil {
+			if _, ok := seen[name]; ok {
+				if _, err := d.keepDuplicate(name, off); err != nil {
+					return err
+				}
+				if err := d.Skip(); err != nil {
+					return err
+				}
+				continue
+			}
+			seen[name] = struct{}{}
+		}
+
+		if f, ok := fs.byName[name]; ok {
+			fv, err := fieldByIndexAlloc(v, f.index)
+			if err != nil {
+				return err
+			}
+			if err := d.DecodeValue(fv); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if fs.inline == nil {
+			if err := d.Skip(); err != nil {
+				return err
+			}
+			continue
+		}
+		m, err := fieldByIndexAlloc(v, fs.inline)
+		if err != nil {
+			return err
+		}
+		if m.IsNil() {
+			m.Set(reflect.MakeMap(m.Type()))
+		}
+		mv := reflect.New(m.Type().Elem()).Elem()
+		if err := d.DecodeValue(mv); err != nil {
+			return err
+		}
+		m.SetMapIndex(reflect.ValueOf(name).Convert(m.Type().Key()), mv)
+	}
+
+	return nil
+}
+
+// BinKey is a bin map key decoded into a Go map. A []byte cannot be a Go
+// map key, so bin keys are held as a BinKey, which is distinct from a
+// string key with the same bytes. The Encoder writes a BinKey as bin.
+type BinKey string
+
+var binKeyType = reflect.TypeOf(BinKey(""))
+
+// decodeMapKey decodes a key for a Go map. Bin keys become BinKey; arrays
+// and maps, which cannot be used as keys, are rejected.
+func (d *Decoder) decodeMapKey() (interface{}, error) {
+	k, err := d.DecodeInterface()
+	if err != nil {
+		return nil, err
+	}
+	if b, ok := k.([]byte); ok {
+		return BinKey(b), nil
+	}
+	if k != nil && !isComparable(k) {
+		return nil, fmt.Errorf("msgpack: invalid map key type %T", k)
+	}
+	return k, nil
+}
+
+func isComparable(v interface{}) bool {
+	return reflect.TypeOf(v).Comparable()
+}
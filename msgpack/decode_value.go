@@ -3,8 +3,372 @@ package msgpack
 import (
 	"fmt"
 	"io"
+	"math"
+	"reflect"
+	"sync"
+	"unsafe"
 )
 
+type (
+	decoderFunc func(*Decoder, reflect.Value) error
+)
+
+var (
+	typeDecMap    sync.Map
+	valueDecoders []decoderFunc
+)
+
+func init() {
+	valueDecoders = []decoderFunc{
+		reflect.Bool:      decodeBoolValue,
+		reflect.Int:       decodeIntValue,
+		reflect.Int8:      decodeIntValue,
+		reflect.Int16:     decodeIntValue,
+		reflect.Int32:     decodeIntValue,
+		reflect.Int64:     decodeIntValue,
+		reflect.Uint:      decodeUintValue,
+		reflect.Uint8:     decodeUintValue,
+		reflect.Uint16:    decodeUintValue,
+		reflect.Uint32:    decodeUintValue,
+		reflect.Uint64:    decodeUintValue,
+		reflect.Float32:   decodeFloatValue,
+		reflect.Float64:   decodeFloatValue,
+		reflect.Interface: decodeInterfaceValue,
+		reflect.Map:       decodeMapValue,
+		reflect.Ptr:       decodePtrValue,
+		reflect.Slice:     decodeSliceValue,
+		reflect.String:    decodeStringValue,
+		reflect.Struct:    decodeStructValue,
+	}
+}
+
+func getDecoder(typ reflect.Type) decoderFunc {
+	if v, ok := typeDecMap.Load(typ); ok {
+		return v.(decoderFunc)
+	}
+
+	if typ == dynamicValueType {
+		return decodeDynamicValue
+	}
+	if typ == extType {
+		return decodeExtValue
+	}
+
+	kind := typ.Kind()
+	if int(kind) >= len(valueDecoders) {
+		return decodeNotFound
+	}
+
+	fn := valueDecoders[kind]
+	if fn == nil {
+		return decodeNotFound
+	}
+
+	typeDecMap.Store(typ, fn)
+	return fn
+}
+
+// DecodeValue decodes the next value into v, which must be settable.
+func (d *Decoder) DecodeValue(v reflect.Value) error {
+	if !v.CanSet() {
+		return fmt.Errorf("msgpack: DecodeValue(non-settable %s)", v.Type())
+	}
+	fn := getDecoder(v.Type())
+	return fn(d, v)
+}
+
+func decodeBoolValue(d *Decoder, v reflect.Value) error {
+	b, err := d.DecodeBool()
+	if err != nil {
+		return err
+	}
+	v.SetBool(b)
+	return nil
+}
+
+func decodeIntValue(d *Decoder, v reflect.Value) error {
+	c, err := d.readCode()
+	if err != nil {
+		return err
+	}
+	if c == Nil {
+		v.SetInt(0)
+		return nil
+	}
+	n, err := d.number(c)
+	if err != nil {
+		return err
+	}
+
+	var i int64
+	switch n := n.(type) {
+	case int64:
+		i = n
+	case uint64:
+		if n > math.MaxInt64 {
+			return overflowError(n, v)
+		}
+		i = int64(n)
+	case float32:
+		if i, err = floatToInt(float64(n), v); err != nil {
+			return err
+		}
+	case float64:
+		if i, err = floatToInt(n, v); err != nil {
+			return err
+		}
+	}
+	if v.OverflowInt(i) {
+		return overflowError(n, v)
+	}
+	v.SetInt(i)
+	return nil
+}
+
+func decodeUintValue(d *Decoder, v reflect.Value) error {
+	c, err := d.readCode()
+	if err != nil {
+		return err
+	}
+	if c == Nil {
+		v.SetUint(0)
+		return nil
+	}
+	n, err := d.number(c)
+	if err != nil {
+		return err
+	}
+
+	var u uint64
+	switch n := n.(type) {
+	case int64:
+		if n < 0 {
+			return overflowError(n, v)
+		}
+		u = uint64(n)
+	case uint64:
+		u = n
+	case float32, float64:
+		f := reflect.ValueOf(n).Float()
+		if f < 0 || f >= 1<<64 {
+			return overflowError(n, v)
+		}
+		if f != math.Trunc(f) {
+			return fmt.Errorf("msgpack: cannot decode %v into %s", n, v.Type())
+		}
+		u = uint64(f)
+	}
+	if v.OverflowUint(u) {
+		return overflowError(n, v)
+	}
+	v.SetUint(u)
+	return nil
+}
+
+func decodeFloatValue(d *Decoder, v reflect.Value) error {
+	c, err := d.readCode()
+	if err != nil {
+		return err
+	}
+	if c == Nil {
+		v.SetFloat(0)
+		return nil
+	}
+	n, err := d.number(c)
+	if err != nil {
+		return err
+	}
+
+	var f float64
+	switch n := n.(type) {
+	case int64:
+		f = float64(n)
+	case uint64:
+		f = float64(n)
+	case float32:
+		f = float64(n)
+	case float64:
+		f = n
+	}
+	if v.OverflowFloat(f) {
+		return overflowError(n, v)
+	}
+	v.SetFloat(f)
+	return nil
+}
+
+func floatToInt(f float64, v reflect.Value) (int64, error) {
+	if f < math.MinInt64 || f >= math.MaxInt64 {
+		return 0, overflowError(f, v)
+	}
+	if f != math.Trunc(f) {
+		return 0, fmt.Errorf("msgpack: cannot decode %v into %s", f, v.Type())
+	}
+	return int64(f), nil
+}
+
+func overflowError(n interface{}, v reflect.Value) error {
+	return fmt.Errorf("msgpack: value %v overflows %s", n, v.Type())
+}
+
+func decodeStringValue(d *Decoder, v reflect.Value) error {
+	s, err := d.DecodeString()
+	if err != nil {
+		return err
+	}
+	v.SetString(s)
+	return nil
+}
+
+func decodeInterfaceValue(d *Decoder, v reflect.Value) error {
+	if v.NumMethod() != 0 {
+		if d.hasNilCode() {
+			_, _ = d.readCode()
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		}
+		return decodeNotFound(d, v)
+	}
+
+	iface, err := d.DecodeInterface()
+	if err != nil {
+		return err
+	}
+	if iface == nil {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	v.Set(reflect.ValueOf(iface))
+	return nil
+}
+
+func decodePtrValue(d *Decoder, v reflect.Value) error {
+	if d.hasNilCode() {
+		_, _ = d.readCode()
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	if v.IsNil() {
+		v.Set(reflect.New(v.Type().Elem()))
+	}
+	return d.DecodeValue(v.Elem())
+}
+
+func decodeMapValue(d *Decoder, v reflect.Value) error {
+	n, err := d.DecodeMapLen()
+	if err != nil {
+		return err
+	}
+
+	typ := v.Type()
+	if n == -1 {
+		v.Set(reflect.Zero(typ))
+		return nil
+	}
+	if v.IsNil() {
+		v.Set(reflect.MakeMapWithSize(typ, min(n, maxMapSize)))
+	}
+
+	keyType := typ.Key()
+	valueType := typ.Elem()
+	keyDec := getDecoder(keyType)
+	valueDec := getDecoder(valueType)
+
+	// Keys held in interfaces are compared normalized, as in
+	// decodeUntypedMapEntries.
+	var seen map[interface{}]struct{}
+	if d.dupKeys != DuplicateKeysLastWins && keyType.Kind() == reflect.Interface {
+		seen = make(map[interface{}]struct{}, min(n, maxMapSize))
+	}
+
+	for i := 0; i < n; i++ {
+		off := d.offset
+		mk := reflect.New(keyType).Elem()
+		if err := keyDec(d, mk); err != nil {
+			return err
+		}
+		if mk.Kind() == reflect.Interface && mk.Elem().IsValid() && !mk.Elem().Type().Comparable() {
+			return fmt.Errorf("msgpack: invalid map key type %s", mk.Elem().Type())
+		}
+		mv := reflect.New(valueType).Elem()
+		if err := valueDec(d, mv); err != nil {
+			return err
+		}
+		dup := d.dupKeys != DuplicateKeysLastWins && v.MapIndex(mk).IsValid()
+		if seen != nil {
+			nk := normalizeKey(mk.Interface())
+			if _, ok := seen[nk]; ok {
+				dup = true
+			}
+			seen[nk] = struct{}{}
+		}
+		if dup {
+			if keep, err := d.keepDuplicate(mk.Interface(), off); err != nil {
+				return err
+			} else if !keep {
+				continue
+			}
+		}
+		v.SetMapIndex(mk, mv)
+	}
+
+	return nil
+}
+
+func decodeSliceValue(d *Decoder, v reflect.Value) error {
+	c, err := d.readCode()
+	if err != nil {
+		return err
+	}
+
+	typ := v.Type()
+	if typ.Elem().Kind() == reflect.Uint8 && (IsString(c) || IsBin(c)) {
+		b, err := d.bytes(c)
+		if err != nil {
+			return err
+		}
+		v.SetBytes(b)
+		return nil
+	}
+
+	n, err := d.arrayLen(c)
+	if err != nil {
+		return err
+	}
+	if n == -1 {
+		v.Set(reflect.Zero(typ))
+		return nil
+	}
+
+	s := reflect.MakeSlice(typ, 0, min(n, sliceAllocLimit))
+	elemDec := getDecoder(typ.Elem())
+	for i := 0; i < n; i++ {
+		s = reflect.Append(s, reflect.Zero(typ.Elem()))
+		if err := elemDec(d, s.Index(i)); err != nil {
+			return err
+		}
+	}
+	v.Set(s)
+	return nil
+}
+
+func decodeExtValue(d *Decoder, v reflect.Value) error {
+	c, err := d.readCode()
+	if err != nil {
+		return err
+	}
+	ext, err := d.ext(c)
+	if err != nil {
+		return err
+	}
+	v.Set(reflect.ValueOf(ext))
+	return nil
+}
+
+func decodeNotFound(d *Decoder, v reflect.Value) error {
+	return fmt.Errorf("msgpack: Decode(unsupported %s)", v.Type())
+}
+
 type unexpectedCodeError struct {
 	code byte
 	hint string
@@ -61,3 +425,10 @@ func min(a, b int) int {
 	}
 	return b
 }
+
+func bytesToString(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	return unsafe.String(unsafe.SliceData(b), len(b))
+}
@@ -0,0 +1,219 @@
+package msgpack
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrNotFound is returned by Document when a path does not address a value.
+var ErrNotFound = errors.New("msgpack: value not found")
+
+// Document gives random access to an encoded value without decoding it in
+// full. Each map or array along an accessed path is scanned once to record
+// the offsets of its entries; after that, lookups only decode the keys of
+// that container and the addressed value. A Document is safe for concurrent
+// use.
+type Document struct {
+	data []byte
+
+	mu      sync.Mutex
+	dec     Decoder
+	dupKeys DuplicateKeyPolicy
+	index   map[int]*docIndex
+}
+
+// docIndex holds the offsets of the entries of one container.
+type docIndex struct {
+	elems []int
+	keys  map[interface{}]int
+}
+
+// NewDocument returns a Document over data, which must not be modified
+// while the Document is in use.
+func NewDocument(data []byte) *Document {
+	return &Document{data: data}
+}
+
+// SetDuplicateKeyPolicy sets which occurrence of a repeated map key a path
+// addresses. The default, DuplicateKeysLastWins, addresses the last one;
+// with DuplicateKeysReject, indexing a map with a repeated key fails with
+// a *DuplicateKeyError.
+func (doc *Document) SetDuplicateKeyPolicy(p DuplicateKeyPolicy) {
+	doc.mu.Lock()
+	defer doc.mu.Unlock()
+
+	doc.dupKeys = p
+	doc.index = nil
+}
+
+// Get decodes the value addressed by path as DecodeInterface would. Each
+// path element is a map key or, for arrays, an int index; integer keys of
+// any Go integer type match integer map keys.
+func (doc *Document) Get(path ...interface{}) (interface{}, error) {
+	doc.mu.Lock()
+	defer doc.mu.Unlock()
+
+	off, err := doc.lookup(path)
+	if err != nil {
+		return nil, err
+	}
+	doc.dec.ResetBytes(doc.data[off:])
+	return doc.dec.DecodeInterface()
+}
+
+// Decode decodes the value addressed by path into v.
+func (doc *Document) Decode(v interface{}, path ...interface{}) error {
+	b, err := doc.Raw(path...)
+	if err != nil {
+		return err
+	}
+	return Unmarshal(b, v)
+}
+
+// Raw returns the encoded bytes of the value addressed by path. The result
+// aliases the Document's data.
+func (doc *Document) Raw(path ...interface{}) ([]byte, error) {
+	doc.mu.Lock()
+	defer doc.mu.Unlock()
+
+	off, err := doc.lookup(path)
+	if err != nil {
+		return nil, err
+	}
+	doc.dec.ResetBytes(doc.data[off:])
+	if err := doc.dec.Skip(); err != nil {
+		return nil, err
+	}
+	end := off + int(doc.dec.InputOffset())
+	return doc.data[off:end:end], nil
+}
+
+func (doc *Document) lookup(path []interface{}) (int, error) {
+	off := 0
+	for i, elem := range path {
+		idx, err := doc.indexAt(off)
+		if err != nil {
+			return 0, err
+		}
+
+		var ok bool
+		if idx.keys != nil {
+			if k := normalizeKey(elem); k == nil || isComparable(k) {
+				off, ok = idx.keys[k]
+			}
+		} else if n, isInt := elem.(int); isInt && n >= 0 && n < len(idx.elems) {
+			off, ok = idx.elems[n], true
+		}
+		if !ok {
+			return 0, fmt.Errorf("%w: %v", ErrNotFound, path[:i+1])
+		}
+	}
+	return off, nil
+}
+
+func (doc *Document) indexAt(off int) (*docIndex, error) {
+	if idx, ok := doc.index[off]; ok {
+		return idx, nil
+	}
+
+	d := &doc.dec
+	d.ResetBytes(doc.data[off:])
+	d.UseLooseInterfaceDecoding(true)
+	d.SetDuplicateKeyPolicy(doc.dupKeys)
+	c, err := d.readCode()
+	if err != nil {
+		return nil, err
+	}
+
+	idx := new(docIndex)
+	switch {
+	case IsFixedMap(c) || c == Map16 || c == Map32:
+		n, err := d.mapLen(c)
+		if err != nil {
+			return nil, err
+		}
+		idx.keys = make(map[interface{}]int, min(n, maxMapSize))
+		for i := 0; i < n; i++ {
+			keyOff := d.offset
+			k, err := d.DecodeInterface()
+			if err != nil {
+				return nil, err
+			}
+			if k = normalizeKey(k); k == nil || isComparable(k) {
+				keep := true
+				if _, ok := idx.keys[k]; ok {
+					if keep, err = d.keepDuplicate(k, int64(off)+keyOff); err != nil {
+						return nil, err
+					}
+				}
+				if keep {
+					idx.keys[k] = off + int(d.offset)
+				}
+			}
+			if err := d.Skip(); err != nil {
+				return nil, err
+			}
+		}
+	case IsFixedArray(c) || c == Array16 || c == Array32:
+		n, err := d.arrayLen(c)
+		if err != nil {
+			return nil, err
+		}
+		idx.elems = make([]int, 0, min(n, sliceAllocLimit))
+		for i := 0; i < n; i++ {
+			idx.elems = append(idx.elems, off+int(d.offset))
+			if err := d.Skip(); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, fmt.Errorf("msgpack: cannot index value with code=%x at offset %d", c, off)
+	}
+
+	if doc.index == nil {
+		doc.index = make(map[int]*docIndex)
+	}
+	doc.index[off] = idx
+	return idx, nil
+}
+
+// normalizeKey converts integer map keys and path elements to the int64
+// that loose interface decoding produces for them, and float32 to float64,
+// so that equal numbers compare equal whatever their width. Bin keys,
+// decoded as []byte, become BinKey.
+func normalizeKey(k interface{}) interface{} {
+	switch k := k.(type) {
+	case int:
+		return int64(k)
+	case int8:
+		return int64(k)
+	case int16:
+		return int64(k)
+	case int32:
+		return int64(k)
+	case uint:
+		return normalizeUint(uint64(k))
+	case uint8:
+		return int64(k)
+	case uint16:
+		return int64(k)
+	case uint32:
+		return int64(k)
+	case uint64:
+		return normalizeUint(k)
+	case float32:
+		return float64(k)
+	case []byte:
+		return BinKey(k)
+	}
+	return k
+}
+
+
+func normalizeUint(n uint64) interface{} {
+	if n <= 1<<63-1 {
+		return int64(n)
+	}
+	return n
+}
@@ -2,10 +2,12 @@ package msgpack
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"math"
 	"reflect"
 	"sync"
+	"unicode/utf8"
 )
 
 type writer interface {
@@ -13,9 +15,26 @@ type writer interface {
 	WriteByte(byte) error
 }
 
+const (
+	fixedContainerHeadersFlag uint32 = 1 << iota
+)
+
 type Encoder struct {
-	w   writer
-	buf []byte
+	w     writer
+	buf   []byte
+	flags uint32
+	utf8  InvalidUTF8Policy
+
+	structTag string
+
+	out     writer
+	pending bytes.Buffer
+	open    []openContainer
+	headers []pendingHeader
+
+	depth    int
+	maxDepth int
+	visited  map[visitKey]struct{}
 }
 
 var encPool = sync.Pool{
@@ -56,6 +75,9 @@ func (e *Encoder) Encode(v interface{}) error {
 }
 
 func (e *Encoder) EncodeValue(v reflect.Value) error {
+	if !v.IsValid() {
+		return e.EncodeNil()
+	}
 	fn := getEncoder(v.Type())
 	return fn(e, v)
 }
@@ -72,6 +94,9 @@ func (e *Encoder) EncodeBool(value bool) error {
 }
 
 func (e *Encoder) EncodeMapLen(l int) error {
+	if err := checkLen(l, "map"); err != nil {
+		return err
+	}
 	if l < 16 {
 		return e.writeCode(FixedMapLow | byte(l))
 	}
@@ -82,7 +107,20 @@ func (e *Encoder) EncodeMapLen(l int) error {
 }
 
 func (e *Encoder) EncodeString(v string) error {
-	if err := e.encodeStringLen(len(v)); err != nil {
+	if e.utf8 != InvalidUTF8Allow && !utf8.ValidString(v) {
+		switch e.utf8 {
+		case InvalidUTF8Reject:
+			return fmt.Errorf("%w: %q", ErrInvalidUTF8, v)
+		case InvalidUTF8Replace:
+			v = replaceInvalidUTF8(v)
+		case InvalidUTF8AsBin:
+			if err := e.EncodeBinLen(len(v)); err != nil {
+				return err
+			}
+			return e.writeString(v)
+		}
+	}
+	if err := e.EncodeStringLen(len(v)); err != nil {
 		return err
 	}
 	return e.writeString(v)
@@ -155,11 +193,45 @@ func (e *Encoder) EncodeUint64(n uint64) error {
 	return e.write8(Uint64, n)
 }
 
+func (e *Encoder) EncodeFloat32(n float32) error {
+	return e.write4(Float, math.Float32bits(n))
+}
+
 func (e *Encoder) EncodeFloat64(n float64) error {
 	return e.write8(Double, math.Float64bits(n))
 }
 
+// EncodeBytes writes b as bin, or nil if b is nil.
+func (e *Encoder) EncodeBytes(b []byte) error {
+	if b == nil {
+		return e.EncodeNil()
+	}
+	if err := e.EncodeBinLen(len(b)); err != nil {
+		return err
+	}
+	return e.write(b)
+}
+
+// EncodeExt writes an ext value of type typ with the payload data.
+func (e *Encoder) EncodeExt(typ int8, data []byte) error {
+	if err := e.EncodeExtHeader(typ, len(data)); err != nil {
+		return err
+	}
+	return e.write(data)
+}
+
+// EncodeRaw writes b verbatim. It is used for payloads after
+// EncodeStringLen, EncodeBinLen and EncodeExtHeader, and for values that
+// are already MessagePack-encoded; the caller is responsible for the result
+// being valid.
+func (e *Encoder) EncodeRaw(b []byte) error {
+	return e.write(b)
+}
+
 func (e *Encoder) EncodeArrayLen(l int) error {
+	if err := checkLen(l, "array"); err != nil {
+		return err
+	}
 	if l < 16 {
 		return e.writeCode(FixedArrayLow | byte(l))
 	}
@@ -169,6 +241,14 @@ func (e *Encoder) EncodeArrayLen(l int) error {
 	return e.write4(Array32, uint32(l))
 }
 
+// checkLen fails for lengths that no header can hold.
+func checkLen(l int, what string) error {
+	if l < 0 || uint64(l) > math.MaxUint32 {
+		return fmt.Errorf("msgpack: invalid %s length %d", what, l)
+	}
+	return nil
+}
+
 func (e *Encoder) write(b []byte) error {
 	_, err := e.w.Write(b)
 	return err
@@ -223,13 +303,39 @@ func (e *Encoder) Reset(w io.Writer) {
 	} else {
 		e.w = newByteWriter(w)
 	}
+	e.flags = 0
+	e.utf8 = InvalidUTF8Allow
+	e.structTag = ""
+	e.out = nil
+	e.open = e.open[:0]
+	e.headers = e.headers[:0]
+	e.depth = 0
+	e.maxDepth = 0
+	e.visited = nil
+}
+
+// SetInvalidUTF8Policy sets how Go strings that are not valid UTF-8 are
+// encoded. The default is InvalidUTF8Allow.
+func (e *Encoder) SetInvalidUTF8Policy(p InvalidUTF8Policy) {
+	e.utf8 = p
+}
+
+// SetCustomStructTag makes struct fields take their names and options from
+// the given tag, such as "json", instead of the msgpack tag.
+func (e *Encoder) SetCustomStructTag(tag string) {
+	e.structTag = tag
 }
 
 func (e *Encoder) Writer() io.Writer {
 	return e.w
 }
 
-func (e *Encoder) encodeStringLen(l int) error {
+// EncodeStringLen writes a str header for l bytes of UTF-8 text, which the
+// caller then writes with EncodeRaw.
+func (e *Encoder) EncodeStringLen(l int) error {
+	if err := checkLen(l, "str"); err != nil {
+		return err
+	}
 	if l < 32 {
 		return e.writeCode(FixedStrLow | byte(l))
 	}
@@ -242,6 +348,64 @@ func (e *Encoder) encodeStringLen(l int) error {
 	return e.write4(Str32, uint32(l))
 }
 
+// EncodeBinLen writes a bin header for l bytes, which the caller then
+// writes with EncodeRaw.
+func (e *Encoder) EncodeBinLen(l int) error {
+	if err := checkLen(l, "bin"); err != nil {
+		return err
+	}
+	if l < 256 {
+		return e.write1(Bin8, uint8(l))
+	}
+	if l <= math.MaxUint16 {
+		return e.write2(Bin16, uint16(l))
+	}
+	return e.write4(Bin32, uint32(l))
+}
+
+// EncodeExtHeader writes the header of an ext value of type typ with an
+// l-byte payload, which the caller then writes with EncodeRaw. Payloads of
+// 1, 2, 4, 8 and 16 bytes use the fixext formats.
+func (e *Encoder) EncodeExtHeader(typ int8, l int) error {
+	if err := checkLen(l, "ext"); err != nil {
+		return err
+	}
+	if c := fixExtCode(l); c != 0 {
+		if err := e.writeCode(c); err != nil {
+			return err
+		}
+	} else if l <= math.MaxUint8 {
+		if err := e.write1(Ext8, uint8(l)); err != nil {
+			return err
+		}
+	} else if l <= math.MaxUint16 {
+		if err := e.write2(Ext16, uint16(l)); err != nil {
+			return err
+		}
+	} else if err := e.write4(Ext32, uint32(l)); err != nil {
+		return err
+	}
+	return e.writeCode(byte(typ))
+}
+
+// fixExtCode returns the fixext code for a payload of l bytes, or 0 if
+// there is none.
+func fixExtCode(l int) byte {
+	switch l {
+	case 1:
+		return FixExt1
+	case 2:
+		return FixExt2
+	case 4:
+		return FixExt4
+	case 8:
+		return FixExt8
+	case 16:
+		return FixExt16
+	}
+	return 0
+}
+
 func (e *Encoder) writeString(s string) error {
 	_, err := e.w.Write(stringToBytes(s))
 	return err
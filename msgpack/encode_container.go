@@ -0,0 +1,297 @@
+package msgpack
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// openContainer is an array or map started with BeginArray or BeginMap
+// whose header has not been written yet. It follows the bytes written
+// inside it to count the values it holds.
+type openContainer struct {
+	start int
+	isMap bool
+
+	// n is the number of values started directly inside the container.
+	n int
+	// owed is the number of nested values the last one still needs, such
+	// as the elements following an EncodeArrayLen header.
+	owed int
+	// skip is the number of payload bytes of the last value still to come.
+	skip int
+	// hdr holds the code and length of a value whose header has only been
+	// written in part.
+	hdr []byte
+}
+
+// observe follows b, the next bytes written inside c.
+func (c *openContainer) observe(b []byte) error {
+	for len(b) > 0 {
+		if c.skip > 0 {
+			k := min(c.skip, len(b))
+			c.skip -= k
+			b = b[k:]
+			continue
+		}
+
+		c.hdr = append(c.hdr, b[0])
+		b = b[1:]
+		if len(c.hdr) < headerLen(c.hdr[0]) {
+			continue
+		}
+		children, payload, err := valueShape(c.hdr)
+		if err != nil {
+			return err
+		}
+		c.hdr = c.hdr[:0]
+		c.startValue(children)
+		c.skip = payload
+	}
+	return nil
+}
+
+// startValue records the start of a value followed by the given number of
+// nested values.
+func (c *openContainer) startValue(children int) {
+	if c.owed == 0 {
+		c.n++
+	} else {
+		c.owed--
+	}
+	c.owed += children
+}
+
+// complete reports whether the last value inside c has been written in
+// full.
+func (c *openContainer) complete() bool {
+	return c.owed == 0 && c.skip == 0 && len(c.hdr) == 0
+}
+
+// headerLen returns the length of the code and length fields of a value
+// starting with c.
+func headerLen(c byte) int {
+	switch c {
+	case Str8, Bin8, Ext8:
+		return 2
+	case Str16, Bin16, Ext16, Array16, Map16:
+		return 3
+	case Str32, Bin32, Ext32, Array32, Map32:
+		return 5
+	}
+	return 1
+}
+
+// valueShape returns the number of nested values and payload bytes that
+// follow the header hdr.
+func valueShape(hdr []byte) (children, payload int, err error) {
+	c := hdr[0]
+	var l int
+	for _, b := range hdr[1:] {
+		l = l<<8 | int(b)
+	}
+
+	switch {
+	case IsFixedNum(c), c == Nil, c == False, c == True:
+		return 0, 0, nil
+	case IsFixedArray(c):
+		return int(c & FixedArrayMask), 0, nil
+	case c == Array16, c == Array32:
+		return l, 0, nil
+	case IsFixedMap(c):
+		return 2 * int(c&FixedMapMask), 0, nil
+	case c == Map16, c == Map32:
+		return 2 * l, 0, nil
+	case IsFixedString(c):
+		return 0, int(c & FixedStrMask), nil
+	case IsString(c), IsBin(c):
+		return 0, l, nil
+	case IsFixedExt(c):
+		return 0, 1<<(c-FixExt1) + 1, nil
+	case IsExt(c):
+		return 0, l + 1, nil
+	case c == Uint8, c == Int8:
+		return 0, 1, nil
+	case c == Uint16, c == Int16:
+		return 0, 2, nil
+	case c == Float, c == Uint32, c == Int32:
+		return 0, 4, nil
+	case c == Double, c == Uint64, c == Int64:
+		return 0, 8, nil
+	}
+	return 0, 0, fmt.Errorf("msgpack: invalid code=%x written inside an open container", c)
+}
+
+// pendingHeader is the header of a closed container, to be inserted at pos
+// in the pending output. level orders the headers of containers that start
+// at the same position, outermost first.
+type pendingHeader struct {
+	pos   int
+	level int
+	b     []byte
+}
+
+// containerWriter is the writer of an Encoder with open containers. It
+// holds the output until the outermost container is closed and lets the
+// innermost one count the values written to it.
+type containerWriter struct {
+	e *Encoder
+}
+
+func (w containerWriter) Write(b []byte) (int, error) {
+	if err := w.e.open[len(w.e.open)-1].observe(b); err != nil {
+		return 0, err
+	}
+	return w.e.pending.Write(b)
+}
+
+func (w containerWriter) WriteByte(c byte) error {
+	if err := w.e.open[len(w.e.open)-1].observe([]byte{c}); err != nil {
+		return err
+	}
+	return w.e.pending.WriteByte(c)
+}
+
+// BeginArray starts an array whose length is not known in advance. Values
+// encoded until the matching EndArray become its elements. Until the
+// outermost open container is closed, the Encoder holds its output in
+// memory; it is written to the underlying writer by the final EndArray or
+// EndMap.
+func (e *Encoder) BeginArray() error {
+	return e.beginContainer(false)
+}
+
+// EndArray closes the array started by the matching BeginArray, writing
+// its header for the number of values encoded since.
+func (e *Encoder) EndArray() error {
+	return e.endContainer(false)
+}
+
+// BeginMap starts a map whose length is not known in advance. Keys and
+// values encoded until the matching EndMap, alternating, become its
+// entries. See BeginArray for how the output is buffered.
+func (e *Encoder) BeginMap() error {
+	return e.beginContainer(true)
+}
+
+// EndMap closes the map started by the matching BeginMap, writing its
+// header for the number of entries encoded since.
+func (e *Encoder) EndMap() error {
+	return e.endContainer(true)
+}
+
+// UseFixedContainerHeaders makes EndArray and EndMap always write Array32
+// and Map32 headers instead of the smallest header that fits.
+func (e *Encoder) UseFixedContainerHeaders(on bool) {
+	if on {
+		e.flags |= fixedContainerHeadersFlag
+	} else {
+		e.flags &= ^fixedContainerHeadersFlag
+	}
+}
+
+func (e *Encoder) beginContainer(isMap bool) error {
+	name := containerName(isMap)
+	if len(e.open) == 0 {
+		e.out = e.w
+		e.pending.Reset()
+		e.headers = e.headers[:0]
+		e.w = containerWriter{e}
+	} else if c := &e.open[len(e.open)-1]; c.skip > 0 || len(c.hdr) > 0 {
+		return fmt.Errorf("msgpack: Begin%s inside an incomplete value", name)
+	}
+	e.open = append(e.open, openContainer{start: e.pending.Len(), isMap: isMap})
+	return nil
+}
+
+func (e *Encoder) endContainer(isMap bool) error {
+	name := containerName(isMap)
+	if len(e.open) == 0 {
+		return fmt.Errorf("msgpack: End%s without Begin%s", name, name)
+	}
+	c := &e.open[len(e.open)-1]
+	if c.isMap != isMap {
+		return fmt.Errorf("msgpack: End%s closes a %s", name, containerName(c.isMap))
+	}
+	if !c.complete() {
+		return fmt.Errorf("msgpack: End%s with an incomplete value", name)
+	}
+
+	n := c.n
+	if isMap {
+		if n%2 != 0 {
+			return errors.New("msgpack: EndMap with a key that has no value")
+		}
+		n /= 2
+	}
+	if uint64(n) > math.MaxUint32 {
+		return fmt.Errorf("msgpack: End%s with %d elements", name, n)
+	}
+
+	e.headers = append(e.headers, pendingHeader{
+		pos:   c.start,
+		level: len(e.open) - 1,
+		b:     appendContainerHeader(nil, n, isMap, e.flags&fixedContainerHeadersFlag != 0),
+	})
+	e.open = e.open[:len(e.open)-1]
+
+	if len(e.open) > 0 {
+		e.open[len(e.open)-1].startValue(0)
+		return nil
+	}
+	e.w = e.out
+	e.out = nil
+	return e.flushPending()
+}
+
+// flushPending writes the pending output with the headers of the closed
+// containers inserted.
+func (e *Encoder) flushPending() error {
+	sort.Slice(e.headers, func(i, j int) bool {
+		a, b := e.headers[i], e.headers[j]
+		if a.pos != b.pos {
+			return a.pos < b.pos
+		}
+		return a.level < b.level
+	})
+
+	b := e.pending.Bytes()
+	var pos int
+	for _, h := range e.headers {
+		if err := e.write(b[pos:h.pos]); err != nil {
+			return err
+		}
+		if err := e.write(h.b); err != nil {
+			return err
+		}
+		pos = h.pos
+	}
+	return e.write(b[pos:])
+}
+
+// appendContainerHeader appends the header of an array or map of n
+// elements or entries to b.
+func appendContainerHeader(b []byte, n int, isMap, fixed bool) []byte {
+	code16, code32 := Array16, Array32
+	fixLow, fixMask := FixedArrayLow, FixedArrayMask
+	if isMap {
+		code16, code32 = Map16, Map32
+		fixLow, fixMask = FixedMapLow, FixedMapMask
+	}
+
+	switch {
+	case !fixed && n <= int(fixMask):
+		return append(b, fixLow|byte(n))
+	case !fixed && n <= math.MaxUint16:
+		return append(b, code16, byte(n>>8), byte(n))
+	}
+	return append(b, code32, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
+
+func containerName(isMap bool) string {
+	if isMap {
+		return "Map"
+	}
+	return "Array"
+}
@@ -0,0 +1,182 @@
+package msgpack
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+const (
+	// defaultMaxDepth is the nesting depth allowed when SetMaxDepth has not
+	// been called.
+	defaultMaxDepth = 10000
+	// startDetectingCyclesAfter is the depth at which the Encoder starts
+	// tracking the maps, slices and pointers it is inside of. Cycles are
+	// rare, so shallow values skip the bookkeeping.
+	startDetectingCyclesAfter = 100
+)
+
+// CycleError is returned when a value contains itself, for example a map
+// stored as one of its own values.
+type CycleError struct {
+	Type reflect.Type
+	// Path locates the repeated value, such as $.N.M[2].
+	Path string
+}
+
+func (err *CycleError) Error() string {
+	return fmt.Sprintf("msgpack: encountered a cycle via %s at %s", err.Type, err.Path)
+}
+
+// MaxDepthError is returned when a value is nested deeper than the limit
+// set with SetMaxDepth.
+type MaxDepthError struct {
+	MaxDepth int
+	// Path locates the value that exceeded the limit.
+	Path string
+}
+
+func (err *MaxDepthError) Error() string {
+	return fmt.Sprintf("msgpack: exceeded max depth of %d at %s", err.MaxDepth, err.Path)
+}
+
+// UnsupportedTypeError is returned when a value has a Go type the Encoder
+// cannot encode.
+type UnsupportedTypeError struct {
+	Type reflect.Type
+	// Path locates the value, such as $.N.M[2].
+	Path string
+}
+
+func (err *UnsupportedTypeError) Error() string {
+	return fmt.Sprintf("msgpack: unsupported type %s at %s", err.Type, err.Path)
+}
+
+// UnsupportedValueError is returned when a value has a supported type but
+// its contents cannot be encoded, such as a string rejected by
+// InvalidUTF8Reject.
+type UnsupportedValueError struct {
+	Value reflect.Value
+	Str   string
+	// Path locates the value, such as $.N.M[2].
+	Path string
+	// Err is the underlying error, if any.
+	Err error
+}
+
+func (err *UnsupportedValueError) Error() string {
+	return fmt.Sprintf("msgpack: unsupported value %q at %s", err.Str, err.Path)
+}
+
+func (err *UnsupportedValueError) Unwrap() error {
+	return err.Err
+}
+
+// pathError is implemented by encoding errors that record where in the
+// value they occurred. The path is built as the error propagates up from
+// the failing value.
+type pathError interface {
+	error
+	prependPath(seg string)
+}
+
+func (err *UnsupportedTypeError) prependPath(seg string) {
+	err.Path = prependPath(err.Path, seg)
+}
+
+func (err *UnsupportedValueError) prependPath(seg string) {
+	err.Path = prependPath(err.Path, seg)
+}
+
+func (err *CycleError) prependPath(seg string) {
+	err.Path = prependPath(err.Path, seg)
+}
+
+func (err *MaxDepthError) prependPath(seg string) {
+	err.Path = prependPath(err.Path, seg)
+}
+
+func prependPath(path, seg string) string {
+	return "$" + seg + path[1:]
+}
+
+// wrapPath adds seg to the front of err's path if err records one.
+func wrapPath(err error, seg string) error {
+	var pe pathError
+	if errors.As(err, &pe) {
+		pe.prependPath(seg)
+	}
+	return err
+}
+
+func keyPathSegment(k reflect.Value) string {
+	if k.Kind() == reflect.Interface {
+		k = k.Elem()
+	}
+	if k.Kind() == reflect.String {
+		return "." + k.String()
+	}
+	if !k.IsValid() {
+		return "[nil]"
+	}
+	return fmt.Sprintf("[%v]", k.Interface())
+}
+
+func indexPathSegment(i int) string {
+	return fmt.Sprintf("[%d]", i)
+}
+
+// SetMaxDepth limits how deeply maps and arrays may be nested in encoded
+// values. n <= 0 restores the default of 10000.
+func (e *Encoder) SetMaxDepth(n int) {
+	e.maxDepth = n
+}
+
+type visitKey struct {
+	ptr uintptr
+	len int
+}
+
+// enter is called before encoding the contents of the map, slice, struct
+// or pointer v. It fails if that nests too deeply or v is already being
+// encoded further up. Structs only count towards the depth, as they can
+// only recur through a map, slice or pointer.
+func (e *Encoder) enter(v reflect.Value) error {
+	e.depth++
+	maxDepth := e.maxDepth
+	if maxDepth <= 0 {
+		maxDepth = defaultMaxDepth
+	}
+	if e.depth > maxDepth {
+		e.depth--
+		return &MaxDepthError{MaxDepth: maxDepth, Path: "$"}
+	}
+
+	if e.depth > startDetectingCyclesAfter && v.Kind() != reflect.Struct {
+		key := visitKey{ptr: v.Pointer()}
+		if v.Kind() == reflect.Slice {
+			key.len = v.Len()
+		}
+		if _, ok := e.visited[key]; ok {
+			e.depth--
+			return &CycleError{Type: v.Type(), Path: "$"}
+		}
+		if e.visited == nil {
+			e.visited = make(map[visitKey]struct{})
+		}
+		e.visited[key] = struct{}{}
+	}
+	return nil
+}
+
+// leave undoes a successful enter.
+func (e *Encoder) leave(v reflect.Value) {
+	if e.depth > startDetectingCyclesAfter && v.Kind() != reflect.Struct {
+		key := visitKey{ptr: v.Pointer()}
+		if v.Kind() == reflect.Slice {
+			key.len = v.Len()
+		}
+		delete(e.visited, key)
+	}
+	e.depth--
+}
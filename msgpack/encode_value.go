@@ -1,8 +1,12 @@
 package msgpack
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"math"
 	"reflect"
+	"sort"
 	"sync"
 )
 
@@ -10,7 +14,11 @@ type (
 	encoderFunc func(*Encoder, reflect.Value) error
 )
 
-var errorType = reflect.TypeOf((*error)(nil)).Elem()
+var (
+	errorType      = reflect.TypeOf((*error)(nil)).Elem()
+	orderedMapType = reflect.TypeOf(OrderedMap(nil))
+	extType        = reflect.TypeOf(Ext{})
+)
 
 var (
 	typeEncMap    sync.Map
@@ -20,12 +28,24 @@ var (
 func init() {
 	valueEncoders = []encoderFunc{
 		reflect.Bool:      encodeBoolValue,
+		reflect.Float32:   encodeFloat32Value,
 		reflect.Float64:   encodeFloat64Value,
 		reflect.Int:       encodeIntValue,
+		reflect.Int8:      encodeIntValue,
+		reflect.Int16:     encodeIntValue,
+		reflect.Int32:     encodeIntValue,
+		reflect.Int64:     encodeIntValue,
+		reflect.Uint:      encodeUintValue,
+		reflect.Uint8:     encodeUintValue,
+		reflect.Uint16:    encodeUintValue,
+		reflect.Uint32:    encodeUintValue,
+		reflect.Uint64:    encodeUintValue,
 		reflect.Interface: encodeInterfaceValue,
 		reflect.Map:       encodeMapValue,
+		reflect.Ptr:       encodePtrValue,
 		reflect.Slice:     encodeSliceValue,
 		reflect.String:    encodeStringValue,
+		reflect.Struct:    encodeStructValue,
 	}
 }
 
@@ -37,13 +57,33 @@ func getEncoder(typ reflect.Type) encoderFunc {
 	if typ == errorType {
 		return encodeErrorValue
 	}
+	if typ == orderedMapType {
+		return encodeOrderedMapValue
+	}
+	if typ == extType {
+		return encodeExtValue
+	}
+	if typ == dynamicValueType {
+		return encodeDynamicValue
+	}
+	if typ == binKeyType {
+		return encodeBinKeyValue
+	}
 
 	kind := typ.Kind()
 	// en:fmt.Println("kind: ", kind)
+	if kind == reflect.Slice && typ.Elem().Kind() == reflect.Uint8 {
+		typeEncMap.Store(typ, encoderFunc(encodeBytesValue))
+		return encodeBytesValue
+	}
+
+	if int(kind) >= len(valueEncoders) {
+		return encodeUnsupported
+	}
 
 	fn := valueEncoders[kind]
 	if fn == nil {
-		return encodeNotFound
+		return encodeUnsupported
 	}
 
 	typeEncMap.Store(typ, fn)
@@ -54,6 +94,10 @@ func encodeBoolValue(e *Encoder, v reflect.Value) error {
 	return e.EncodeBool(v.Bool())
 }
 
+func encodeFloat32Value(e *Encoder, v reflect.Value) error {
+	return e.EncodeFloat32(float32(v.Float()))
+}
+
 func encodeFloat64Value(e *Encoder, v reflect.Value) error {
 	return e.EncodeFloat64(v.Float())
 }
@@ -62,6 +106,10 @@ func encodeIntValue(e *Encoder, v reflect.Value) error {
 	return e.EncodeInt(v.Int())
 }
 
+func encodeUintValue(e *Encoder, v reflect.Value) error {
+	return e.EncodeUint(v.Uint())
+}
+
 func encodeInterfaceValue(e *Encoder, v reflect.Value) error {
 	if v.IsNil() {
 		return e.EncodeNil()
@@ -74,25 +122,167 @@ func encodeMapValue(e *Encoder, v reflect.Value) error {
 		return e.EncodeNil()
 	}
 
+	if err := e.enter(v); err != nil {
+		return err
+	}
+	defer e.leave(v)
+
 	if err := e.EncodeMapLen(v.Len()); err != nil {
 		return err
 	}
 
-	iter := v.MapRange()
-	for iter.Next() {
-		if err := e.EncodeValue(iter.Key()); err != nil {
-			return err
+	// Keys are sorted so that encoding the same map always gives the same
+	// bytes. Use OrderedMap to choose the order instead.
+	keys := v.MapKeys()
+	sortMapKeys(keys)
+	for _, k := range keys {
+		if err := e.EncodeValue(k); err != nil {
+			return wrapPath(err, keyPathSegment(k))
 		}
-		if err := e.EncodeValue(iter.Value()); err != nil {
-			return err
+		if err := e.EncodeValue(v.MapIndex(k)); err != nil {
+			return wrapPath(err, keyPathSegment(k))
 		}
 	}
 
 	return nil
 }
 
+func encodeOrderedMapValue(e *Encoder, v reflect.Value) error {
+	if v.IsNil() {
+		return e.EncodeNil()
+	}
+
+	if err := e.enter(v); err != nil {
+		return err
+	}
+	defer e.leave(v)
+
+	l := v.Len()
+	if err := e.EncodeMapLen(l); err != nil {
+		return err
+	}
+	for i := 0; i < l; i++ {
+		kv := v.Index(i)
+		if err := e.EncodeValue(kv.Field(0)); err != nil {
+			return wrapPath(err, keyPathSegment(kv.Field(0)))
+		}
+		if err := e.EncodeValue(kv.Field(1)); err != nil {
+			return wrapPath(err, keyPathSegment(kv.Field(0)))
+		}
+	}
+	return nil
+}
+
+func sortMapKeys(keys []reflect.Value) {
+	sort.Slice(keys, func(i, j int) bool {
+		return lessValue(keys[i], keys[j])
+	})
+}
+
+// lessValue orders map keys the way compareValues orders their canonical
+// forms, so that the Encoder's output passes RequireSortedMapKeys: by
+// keyKind first, then by value, with integers of every Go type compared
+// with each other and float32 with float64.
+func lessValue(a, b reflect.Value) bool {
+	if a.Kind() == reflect.Interface {
+		a = a.Elem()
+	}
+	if b.Kind() == reflect.Interface {
+		b = b.Elem()
+	}
+	ka, kb := keyKind(a), keyKind(b)
+	if ka != kb {
+		return ka < kb
+	}
+
+	switch ka {
+	case KindBool:
+		return !a.Bool() && b.Bool()
+	case KindInt:
+		return intKey(a) < intKey(b)
+	case KindUint:
+		return a.Uint() < b.Uint()
+	case KindDouble:
+		return a.Float() < b.Float()
+	case KindStr:
+		return a.String() < b.String()
+	case KindBin:
+		return bytes.Compare(binBytes(a), binBytes(b)) < 0
+	}
+	return false
+}
+
+// keyKind returns the Kind of the canonical form of v's encoding.
+func keyKind(v reflect.Value) Kind {
+	switch v.Kind() {
+	case reflect.Invalid:
+		return KindNil
+	case reflect.Bool:
+		return KindBool
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return KindInt
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if v.Uint() <= math.MaxInt64 {
+			return KindInt
+		}
+		return KindUint
+	case reflect.Float32, reflect.Float64:
+		return KindDouble
+	case reflect.String:
+		if v.Type() == binKeyType {
+			return KindBin
+		}
+		return KindStr
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return KindBin
+		}
+		return KindArray
+	case reflect.Array:
+		return KindArray
+	case reflect.Struct:
+		if v.Type() == extType {
+			return KindExt
+		}
+	}
+	return KindMap
+}
+
+// binBytes returns the bytes of a key of keyKind KindBin.
+func binBytes(v reflect.Value) []byte {
+	if v.Kind() == reflect.String {
+		return []byte(v.String())
+	}
+	return v.Bytes()
+}
+
+// intKey returns a key of keyKind KindInt as an int64.
+func intKey(v reflect.Value) int64 {
+	if v.CanInt() {
+		return v.Int()
+	}
+	return int64(v.Uint())
+}
+
 func encodeStringValue(e *Encoder, v reflect.Value) error {
-	return e.EncodeString(v.String())
+	if err := e.EncodeString(v.String()); err != nil {
+		if errors.Is(err, ErrInvalidUTF8) {
+			return &UnsupportedValueError{Value: v, Str: v.String(), Path: "$", Err: err}
+		}
+		return err
+	}
+	return nil
+}
+
+func encodeBinKeyValue(e *Encoder, v reflect.Value) error {
+	if err := e.EncodeBinLen(v.Len()); err != nil {
+		return err
+	}
+	return e.writeString(v.String())
+}
+
+func encodeBytesValue(e *Encoder, v reflect.Value) error {
+	return e.EncodeBytes(v.Bytes())
 }
 
 func encodeSliceValue(e *Encoder, v reflect.Value) error {
@@ -100,15 +290,98 @@ func encodeSliceValue(e *Encoder, v reflect.Value) error {
 		return e.EncodeNil()
 	}
 
+	if err := e.enter(v); err != nil {
+		return err
+	}
+	defer e.leave(v)
+
 	l := v.Len()
 	if err := e.EncodeArrayLen(l); err != nil {
 		return err
 	}
 	for i := 0; i < l; i++ {
 		if err := e.EncodeValue(v.Index(i)); err != nil {
+			return wrapPath(err, indexPathSegment(i))
+		}
+	}
+	return nil
+}
+
+func encodeExtValue(e *Encoder, v reflect.Value) error {
+	ext := v.Interface().(Ext)
+	return e.EncodeExt(ext.Type, ext.Data)
+}
+
+func encodePtrValue(e *Encoder, v reflect.Value) error {
+	if v.IsNil() {
+		return e.EncodeNil()
+	}
+	if err := e.enter(v); err != nil {
+		return err
+	}
+	defer e.leave(v)
+	return e.EncodeValue(v.Elem())
+}
+
+// encodeStructValue encodes v as a map from field names to field values,
+// followed by the entries of its inline map if it has one.
+func encodeStructValue(e *Encoder, v reflect.Value) error {
+	if err := e.enter(v); err != nil {
+		return err
+	}
+	defer e.leave(v)
+
+	fs := getStructFields(v.Type(), e.structTag)
+	fields := make([]reflect.Value, len(fs.list))
+	n := 0
+	for i, f := range fs.list {
+		fv, ok := fieldByIndex(v, f.index)
+		if !ok || f.omitEmpty && isEmptyValue(fv) {
+			continue
+		}
+		fields[i] = fv
+		n++
+	}
+
+	var inline reflect.Value
+	if fs.inline != nil {
+		if m, ok := fieldByIndex(v, fs.inline); ok && m.Len() > 0 {
+			inline = m
+			n += m.Len()
+		}
+	}
+
+	if err := e.EncodeMapLen(n); err != nil {
+		return err
+	}
+	for i, f := range fs.list {
+		if !fields[i].IsValid() {
+			continue
+		}
+		if err := e.EncodeString(f.name); err != nil {
 			return err
 		}
+		if err := e.EncodeValue(fields[i]); err != nil {
+			return wrapPath(err, "."+f.name)
+		}
+	}
+
+	if inline.IsValid() {
+		keys := inline.MapKeys()
+		sortMapKeys(keys)
+		for _, k := range keys {
+			if _, ok := fs.byName[k.String()]; ok {
+				return fmt.Errorf("msgpack: inline map key %q duplicates a field of %s", k.String(), v.Type())
+			}
+			if err := e.EncodeString(k.String()); err != nil {
+				return err
+			}
+			if err := e.EncodeValue(inline.MapIndex(k)); err != nil {
+				return wrapPath(err, keyPathSegment(k))
+			}
+		}
 	}
+
 	return nil
 }
 
@@ -119,6 +392,6 @@ func encodeErrorValue(e *Encoder, v reflect.Value) error {
 	return e.EncodeString(v.Interface().(error).Error())
 }
 
-func encodeNotFound(e *Encoder, v reflect.Value) error {
-	return fmt.Errorf("encode map key(%s) not found", v.Type().Kind().String())
+func encodeUnsupported(e *Encoder, v reflect.Value) error {
+	return &UnsupportedTypeError{Type: v.Type(), Path: "$"}
 }
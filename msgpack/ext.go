@@ -0,0 +1,69 @@
+package msgpack
+
+import "fmt"
+
+// Ext is a MessagePack extension value: an application-defined type code and
+// its raw payload.
+type Ext struct {
+	Type int8
+	Data []byte
+}
+
+func (d *Decoder) ext(c byte) (Ext, error) {
+	typ, n, err := d.extHeader(c)
+	if err != nil {
+		return Ext{}, err
+	}
+	if n == 0 {
+		return Ext{Type: typ, Data: []byte{}}, nil
+	}
+	if d.noCopy() {
+		b, err := d.sliceN(n)
+		return Ext{Type: typ, Data: b}, err
+	}
+	b, err := d.readN(n)
+	if err != nil {
+		return Ext{}, err
+	}
+	return Ext{Type: typ, Data: append(make([]byte, 0, n), b...)}, nil
+}
+
+func (d *Decoder) extHeader(c byte) (int8, int, error) {
+	n, err := d.extLen(c)
+	if err != nil {
+		return 0, 0, err
+	}
+	typ, err := d.int8()
+	if err != nil {
+		return 0, 0, err
+	}
+	return typ, n, nil
+}
+
+func (d *Decoder) extLen(c byte) (int, error) {
+	switch c {
+	case FixExt1:
+		return 1, nil
+	case FixExt2:
+		return 2, nil
+	case FixExt4:
+		return 4, nil
+	case FixExt8:
+		return 8, nil
+	case FixExt16:
+		return 16, nil
+	case Ext8:
+		n, err := d.uint8()
+		return int(n), err
+	case Ext16:
+		n, err := d.uint16()
+		return int(n), err
+	case Ext32:
+		n, err := d.uint32()
+		if err != nil {
+			return 0, err
+		}
+		return length32(n)
+	}
+	return 0, fmt.Errorf("msgpack: invalid code=%x decoding ext length", c)
+}
@@ -0,0 +1,255 @@
+package msgpack
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const defaultStructTag = "msgpack"
+
+var jsonTagFallback atomic.Bool
+
+// UseJSONTagFallback makes struct fields that have no msgpack tag, or no
+// custom tag set with SetCustomStructTag, use their json tag instead,
+// including its omitempty and "-" options. It applies to every Encoder
+// and Decoder.
+func UseJSONTagFallback(on bool) {
+	jsonTagFallback.Store(on)
+}
+
+// field is a struct field encoded as a map entry.
+type field struct {
+	name      string
+	index     []int
+	typ       reflect.Type
+	omitEmpty bool
+	tagged    bool
+}
+
+// structFields describes how a struct type maps to an encoded map. Fields
+// of embedded structs and fields tagged inline appear in list as if they
+// were declared in the outer struct.
+type structFields struct {
+	list   []*field
+	byName map[string]*field
+	// inline is the index of the map that collects keys which do not match
+	// any field, or nil.
+	inline []int
+}
+
+// structFieldsKey identifies a struct type together with the tags its
+// field names are read from.
+type structFieldsKey struct {
+	typ      reflect.Type
+	tag      string
+	fallback string
+}
+
+var structFieldsCache sync.Map
+
+// getStructFields returns the fields of typ named by tag, or by the msgpack
+// tag if tag is empty.
+func getStructFields(typ reflect.Type, tag string) *structFields {
+	if tag == "" {
+		tag = defaultStructTag
+	}
+	key := structFieldsKey{typ: typ, tag: tag}
+	if tag != "json" && jsonTagFallback.Load() {
+		key.fallback = "json"
+	}
+
+	if v, ok := structFieldsCache.Load(key); ok {
+		return v.(*structFields)
+	}
+	fs := newStructFields(key)
+	v, _ := structFieldsCache.LoadOrStore(key, fs)
+	return v.(*structFields)
+}
+
+func newStructFields(key structFieldsKey) *structFields {
+	fs := new(structFields)
+	var all []*field
+	collectFields(fs, &all, key, key.typ, nil, map[reflect.Type]bool{})
+
+	// As in encoding/json, a name used at several depths belongs to the
+	// shallowest field, and within a depth to the only tagged one. Names
+	// that stay ambiguous are dropped.
+	sort.SliceStable(all, func(i, j int) bool {
+		a, b := all[i], all[j]
+		if a.name != b.name {
+			return a.name < b.name
+		}
+		if len(a.index) != len(b.index) {
+			return len(a.index) < len(b.index)
+		}
+		return a.tagged && !b.tagged
+	})
+	for i := 0; i < len(all); {
+		j := i + 1
+		for j < len(all) && all[j].name == all[i].name {
+			j++
+		}
+		group := all[i:j]
+		if len(group) == 1 || len(group[1].index) > len(group[0].index) ||
+			group[0].tagged && !group[1].tagged {
+			fs.list = append(fs.list, group[0])
+		}
+		i = j
+	}
+
+	sort.Slice(fs.list, func(i, j int) bool {
+		return lessIndex(fs.list[i].index, fs.list[j].index)
+	})
+	fs.byName = make(map[string]*field, len(fs.list))
+	for _, f := range fs.list {
+		fs.byName[f.name] = f
+	}
+	return fs
+}
+
+func collectFields(fs *structFields, all *[]*field, key structFieldsKey, typ reflect.Type, index []int, visiting map[reflect.Type]bool) {
+	if visiting[typ] {
+		return
+	}
+	visiting[typ] = true
+	defer delete(visiting, typ)
+
+	for i := 0; i < typ.NumField(); i++ {
+		sf := typ.Field(i)
+		ft := sf.Type
+		if ft.Kind() == reflect.Ptr && ft.Elem().Kind() == reflect.Struct {
+			ft = ft.Elem()
+		}
+		if !sf.IsExported() && !(sf.Anonymous && ft.Kind() == reflect.Struct) {
+			continue
+		}
+
+		tag, ok := sf.Tag.Lookup(key.tag)
+		if !ok && key.fallback != "" {
+			tag = sf.Tag.Get(key.fallback)
+		}
+		if tag == "-" {
+			continue
+		}
+		name, opts := parseTag(tag)
+		idx := make([]int, len(index)+1)
+		copy(idx, index)
+		idx[len(index)] = i
+
+		inline := opts.has("inline")
+		if inline && sf.Type.Kind() == reflect.Map && sf.Type.Key().Kind() == reflect.String {
+			if fs.inline == nil || len(idx) < len(fs.inline) {
+				fs.inline = idx
+			}
+			continue
+		}
+		if ft.Kind() == reflect.Struct && (inline || sf.Anonymous && name == "") {
+			collectFields(fs, all, key, ft, idx, visiting)
+			continue
+		}
+		if !sf.IsExported() {
+			continue
+		}
+
+		f := &field{
+			name:      name,
+			index:     idx,
+			typ:       sf.Type,
+			omitEmpty: opts.has("omitempty"),
+			tagged:    name != "",
+		}
+		if f.name == "" {
+			f.name = sf.Name
+		}
+		*all = append(*all, f)
+	}
+}
+
+type tagOptions string
+
+func parseTag(tag string) (string, tagOptions) {
+	if i := strings.IndexByte(tag, ','); i >= 0 {
+		return tag[:i], tagOptions(tag[i+1:])
+	}
+	return tag, ""
+}
+
+func (o tagOptions) has(name string) bool {
+	for s := string(o); s != ""; {
+		var opt string
+		if i := strings.IndexByte(s, ','); i >= 0 {
+			opt, s = s[:i], s[i+1:]
+		} else {
+			opt, s = s, ""
+		}
+		if opt == name {
+			return true
+		}
+	}
+	return false
+}
+
+func lessIndex(a, b []int) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return len(a) < len(b)
+}
+
+// fieldByIndex returns the field of v at index. ok is false if a nil
+// embedded pointer is on the way.
+func fieldByIndex(v reflect.Value, index []int) (_ reflect.Value, ok bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+// fieldByIndexAlloc is like fieldByIndex but allocates nil embedded
+// pointers on the way.
+func fieldByIndexAlloc(v reflect.Value, index []int) (reflect.Value, error) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				if !v.CanSet() {
+					return reflect.Value{}, fmt.Errorf(
+						"msgpack: cannot set embedded pointer to unexported struct %s", v.Type().Elem())
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, nil
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
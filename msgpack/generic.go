@@ -0,0 +1,55 @@
+package msgpack
+
+import "io"
+
+// UnmarshalAs decodes data, which must hold exactly one value, as a T.
+func UnmarshalAs[T any](data []byte) (T, error) {
+	var v T
+	err := Unmarshal(data, &v)
+	return v, err
+}
+
+// DecodeAs decodes the next value from d as a T.
+func DecodeAs[T any](d *Decoder) (T, error) {
+	var v T
+	err := d.Decode(&v)
+	return v, err
+}
+
+// Reader decodes a stream of back-to-back T values.
+type Reader[T any] struct {
+	dec *Decoder
+}
+
+func NewReader[T any](r io.Reader) *Reader[T] {
+	return &Reader[T]{dec: NewDecoder(r)}
+}
+
+// Read returns the next value in the stream. It returns io.EOF once the
+// stream ends cleanly between values.
+func (r *Reader[T]) Read() (T, error) {
+	return DecodeAs[T](r.dec)
+}
+
+// Decoder returns the underlying Decoder, for setting decoding options.
+func (r *Reader[T]) Decoder() *Decoder {
+	return r.dec
+}
+
+// Writer encodes a stream of back-to-back T values.
+type Writer[T any] struct {
+	enc *Encoder
+}
+
+func NewWriter[T any](w io.Writer) *Writer[T] {
+	return &Writer[T]{enc: NewEncoder(w)}
+}
+
+func (w *Writer[T]) Write(v T) error {
+	return w.enc.Encode(v)
+}
+
+// Encoder returns the underlying Encoder, for setting encoding options.
+func (w *Writer[T]) Encoder() *Encoder {
+	return w.enc
+}
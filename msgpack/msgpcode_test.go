@@ -1,12 +1,19 @@
 package msgpack_test
 
 import (
+    "bytes"
+    "crypto/sha256"
     "encoding/hex"
     "encoding/json"
     "fmt"
+    "io"
+    "math"
+    "reflect"
+    "strings"
     . "msgpack/msgpack"
     "testing"
     "time"
+    "unsafe"
 
     "github.com/stretchr/testify/require"
 )
@@ -138,3 +145,1158 @@ func TestUnmarshal(t *testing.T) {
         t.Logf("(%d) %s\nInput: %x\nExpected: %s\nActual:   %s\n", i+1, test.name, test.in, test.expected, string(result))
     }
 }
+
+func TestUnmarshalTrailingBytes(t *testing.T) {
+    var data map[string]interface{}
+    err := Unmarshal([]byte{0x81, 0xa1, 0x4d, 0xc2, 0x00}, &data)
+    require.ErrorIs(t, err, ErrTrailingBytes)
+
+    dec := NewDecoder(io.MultiReader(bytes.NewReader([]byte{0x81, 0xa1, 0x4d, 0xc2, 0x80, 0x00})))
+    require.NoError(t, dec.Decode(&data))
+    require.Equal(t, int64(4), dec.InputOffset())
+
+    rest, err := io.ReadAll(dec.Buffered())
+    require.NoError(t, err)
+    require.Equal(t, []byte{0x80, 0x00}, rest)
+
+    dec.Strict(true)
+    require.ErrorIs(t, dec.Decode(&data), ErrTrailingBytes)
+}
+
+func TestUnmarshalNoCopy(t *testing.T) {
+    in := []byte{0xc4, 0x03, 0x01, 0x02, 0x03}
+
+    var b []byte
+    require.NoError(t, Unmarshal(in, &b))
+    require.Equal(t, []byte{0x01, 0x02, 0x03}, b)
+    in[2] = 0x09
+    require.Equal(t, byte(0x01), b[0])
+
+    require.NoError(t, UnmarshalNoCopy(in, &b))
+    require.Equal(t, []byte{0x09, 0x02, 0x03}, b)
+    require.Equal(t, 3, cap(b))
+    in[2] = 0x01
+    require.Equal(t, byte(0x01), b[0])
+
+    str := []byte{0xa3, 0x61, 0x62, 0x63}
+    dec := NewDecoder(nil)
+    dec.ResetBytes(str)
+    dec.UseZeroCopy(true)
+    dec.UseUnsafeStrings(true)
+    s, err := dec.DecodeString()
+    require.NoError(t, err)
+    require.Equal(t, "abc", s)
+    require.Equal(t, int64(4), dec.InputOffset())
+}
+
+func TestDecoderStream(t *testing.T) {
+    in := []byte{0x81, 0xa1, 0x4d, 0xc2, 0x81, 0xa1, 0x4d, 0xc3}
+    dec := NewDecoder(io.MultiReader(bytes.NewReader(in)))
+
+    var n int
+    for dec.More() {
+        var data map[string]interface{}
+        require.NoError(t, dec.Decode(&data))
+        n++
+    }
+    require.Equal(t, 2, n)
+
+    var data map[string]interface{}
+    require.Equal(t, io.EOF, dec.Decode(&data))
+
+    dec.Reset(io.MultiReader(bytes.NewReader(in[:6])))
+    require.NoError(t, dec.Decode(&data))
+    require.Equal(t, io.ErrUnexpectedEOF, dec.Decode(&data))
+
+    dec.ResetBytes(in[:3])
+    require.Equal(t, io.ErrUnexpectedEOF, dec.Decode(&data))
+}
+
+func TestDecoderSetMapDecoder(t *testing.T) {
+    in := []byte{0x82, 0xa1, 0x4e, 0x81, 0xa1, 0x4d, 0xc3, 0xa1, 0x4c, 0xc2}
+
+    dec := NewDecoder(nil)
+    dec.ResetBytes(in)
+    dec.SetMapDecoder(UntypedMapDecoder)
+    v, err := dec.DecodeInterface()
+    require.NoError(t, err)
+    require.Equal(t, map[interface{}]interface{}{
+        "N": map[interface{}]interface{}{"M": true},
+        "L": false,
+    }, v)
+
+    dec.ResetBytes(in)
+    dec.SetMapDecoder(OrderedMapDecoder)
+    v, err = dec.DecodeInterface()
+    require.NoError(t, err)
+    require.Equal(t, OrderedMap{
+        {Key: "N", Value: OrderedMap{{Key: "M", Value: true}}},
+        {Key: "L", Value: false},
+    }, v)
+
+    dec.ResetBytes(in)
+    dec.SetMapDecoder(StringMapDecoder)
+    v, err = dec.DecodeInterface()
+    require.NoError(t, err)
+    require.Equal(t, map[string]interface{}{
+        "N": map[string]interface{}{"M": true},
+        "L": false,
+    }, v)
+}
+
+func TestOrderedMapRoundTrip(t *testing.T) {
+    in := []byte{0x83, 0xa1, 0x5a, 0xc3, 0xa1, 0x41, 0x81, 0xa1, 0x4d, 0xa1, 0x30, 0xa1, 0x4b, 0x92, 0x00, 0x01}
+
+    dec := NewDecoder(nil)
+    dec.ResetBytes(in)
+    dec.SetMapDecoder(OrderedMapDecoder)
+    var v interface{}
+    require.NoError(t, dec.Decode(&v))
+
+    m := v.(OrderedMap)
+    require.Equal(t, "Z", m[0].Key)
+    a, ok := m.Get("A")
+    require.True(t, ok)
+    require.Equal(t, OrderedMap{{Key: "M", Value: "0"}}, a)
+
+    b, err := Marshal(v)
+    require.NoError(t, err)
+    require.Equal(t, in, b)
+
+    b, err = Marshal(map[string]interface{}{"Z": true, "A": 0, "K": nil})
+    require.NoError(t, err)
+    require.Equal(t, "83a14100a14bc0a15ac3", hex.EncodeToString(b))
+
+    m = OrderedMap{{Key: []interface{}{1}, Value: 1}, {Key: []byte("k"), Value: 2}, {Key: "k", Value: 3}}
+    a, ok = m.Get([]byte("k"))
+    require.True(t, ok)
+    require.Equal(t, 2, a)
+    a, ok = m.Get("k")
+    require.True(t, ok)
+    require.Equal(t, 3, a)
+    _, ok = m.Get([]interface{}{1})
+    require.False(t, ok)
+}
+
+func TestDecodeNonStringMapKeys(t *testing.T) {
+    // {1: "a", "b": true, -1: false}
+    in := []byte{0x83, 0x01, 0xa1, 0x61, 0xa1, 0x62, 0xc3, 0xff, 0xc2}
+
+    var v interface{}
+    require.NoError(t, Unmarshal(in, &v))
+    require.Equal(t, map[interface{}]interface{}{int64(1): "a", "b": true, int64(-1): false}, v)
+
+    // {"b": true, 1: "a"}
+    in = []byte{0x82, 0xa1, 0x62, 0xc3, 0x01, 0xa1, 0x61}
+    require.NoError(t, Unmarshal(in, &v))
+    require.Equal(t, map[interface{}]interface{}{"b": true, int64(1): "a"}, v)
+
+    var m map[string]interface{}
+    require.EqualError(t, Unmarshal(in, &m), "msgpack: unexpected code=1 decoding string map key")
+
+    // {"a": 2, bin "a": 1}
+    in = []byte{0x82, 0xa1, 0x61, 0x02, 0xc4, 0x01, 0x61, 0x01}
+    require.NoError(t, Unmarshal(in, &v))
+    require.Equal(t, map[interface{}]interface{}{BinKey("a"): int64(1), "a": int64(2)}, v)
+    b, err := Marshal(v)
+    require.NoError(t, err)
+    require.Equal(t, in, b)
+    size, err := EncodedSize(v)
+    require.NoError(t, err)
+    require.Equal(t, len(in), size)
+
+    // {1: "a", 2: "b"}
+    in = []byte{0x82, 0x01, 0xa1, 0x61, 0x02, 0xa1, 0x62}
+    var im map[int]string
+    require.NoError(t, Unmarshal(in, &im))
+    require.Equal(t, map[int]string{1: "a", 2: "b"}, im)
+
+    var um map[uint64]string
+    require.NoError(t, Unmarshal(in, &um))
+    require.Equal(t, map[uint64]string{1: "a", 2: "b"}, um)
+
+    // {true: [1], false: nil}
+    in = []byte{0x82, 0xc3, 0x91, 0x01, 0xc2, 0xc0}
+    var bm map[bool][]int16
+    require.NoError(t, Unmarshal(in, &bm))
+    require.Equal(t, map[bool][]int16{true: {1}, false: nil}, bm)
+}
+
+func TestDecodeNumbers(t *testing.T) {
+    // [5, -3, 200 (uint8), -200 (int16), 1.5 (float), 0.25 (double)]
+    in := []byte{0x96, 0x05, 0xfd, 0xcc, 0xc8, 0xd1, 0xff, 0x38, 0xca, 0x3f, 0xc0, 0x00, 0x00, 0xcb, 0x3f, 0xd0, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+
+    var v interface{}
+    require.NoError(t, Unmarshal(in, &v))
+    require.Equal(t, []interface{}{int64(5), int64(-3), uint64(200), int64(-200), float32(1.5), 0.25}, v)
+
+    dec := NewDecoder(nil)
+    dec.ResetBytes(in)
+    dec.UseLooseInterfaceDecoding(true)
+    require.NoError(t, dec.Decode(&v))
+    require.Equal(t, []interface{}{int64(5), int64(-3), int64(200), int64(-200), 1.5, 0.25}, v)
+
+    var i16 []int16
+    require.EqualError(t, Unmarshal(in, &i16), "msgpack: cannot decode 1.5 into int16")
+
+    var i8 []int8
+    require.EqualError(t, Unmarshal(in, &i8), "msgpack: value 200 overflows int8")
+
+    var u []uint
+    require.EqualError(t, Unmarshal(in, &u), "msgpack: value -3 overflows uint")
+
+    var f []float32
+    require.NoError(t, Unmarshal(in, &f))
+    require.Equal(t, []float32{5, -3, 200, -200, 1.5, 0.25}, f)
+
+    var n int64
+    require.NoError(t, Unmarshal([]byte{0xcb, 0x40, 0x59, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, &n))
+    require.Equal(t, int64(100), n)
+}
+
+func TestGenericHelpers(t *testing.T) {
+    m, err := UnmarshalAs[map[string]int]([]byte{0x81, 0xa1, 0x4d, 0x07})
+    require.NoError(t, err)
+    require.Equal(t, map[string]int{"M": 7}, m)
+
+    var buf bytes.Buffer
+    w := NewWriter[[]string](&buf)
+    require.NoError(t, w.Write([]string{"a"}))
+    require.NoError(t, w.Write([]string{"b", "c"}))
+
+    r := NewReader[[]string](&buf)
+    s, err := r.Read()
+    require.NoError(t, err)
+    require.Equal(t, []string{"a"}, s)
+    s, err = r.Read()
+    require.NoError(t, err)
+    require.Equal(t, []string{"b", "c"}, s)
+    _, err = r.Read()
+    require.Equal(t, io.EOF, err)
+}
+
+func TestDecodeDuplicateKeys(t *testing.T) {
+    // {"a": 1, "b": 2, "a": 3}
+    in := []byte{0x83, 0xa1, 0x61, 0x01, 0xa1, 0x62, 0x02, 0xa1, 0x61, 0x03}
+
+    var m map[string]interface{}
+    require.NoError(t, Unmarshal(in, &m))
+    require.Equal(t, map[string]interface{}{"a": int64(3), "b": int64(2)}, m)
+
+    dec := NewDecoder(nil)
+    dec.ResetBytes(in)
+    dec.SetDuplicateKeyPolicy(DuplicateKeysFirstWins)
+    require.NoError(t, dec.Decode(&m))
+    require.Equal(t, map[string]interface{}{"a": int64(1), "b": int64(2)}, m)
+
+    var im map[string]int
+    dec.ResetBytes(in)
+    dec.SetDuplicateKeyPolicy(DuplicateKeysFirstWins)
+    require.NoError(t, dec.Decode(&im))
+    require.Equal(t, map[string]int{"a": 1, "b": 2}, im)
+
+    dec.ResetBytes(in)
+    dec.SetDuplicateKeyPolicy(DuplicateKeysReject)
+    err := dec.Decode(&m)
+    var dupErr *DuplicateKeyError
+    require.ErrorAs(t, err, &dupErr)
+    require.Equal(t, "a", dupErr.Key)
+    require.Equal(t, int64(7), dupErr.Offset)
+
+    dec.ResetBytes(in)
+    dec.SetDuplicateKeyPolicy(DuplicateKeysReject)
+    dec.SetMapDecoder(OrderedMapDecoder)
+    var v interface{}
+    require.ErrorAs(t, dec.Decode(&v), &dupErr)
+
+    // {1: "x", uint8 1: "y", float 1.5: nil, double 1.5: nil}: the same
+    // keys in different widths.
+    ints := []byte{0x82, 0x01, 0xa1, 0x78, 0xcc, 0x01, 0xa1, 0x79}
+    floats := []byte{0x82, 0xca, 0x3f, 0xc0, 0x00, 0x00, 0xc0, 0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0, 0xc0}
+    for _, mapDecoder := range []func(*Decoder) (interface{}, error){nil, UntypedMapDecoder, OrderedMapDecoder} {
+        for _, b := range [][]byte{ints, floats} {
+            dec.ResetBytes(b)
+            dec.SetDuplicateKeyPolicy(DuplicateKeysReject)
+            dec.SetMapDecoder(mapDecoder)
+            require.ErrorAs(t, dec.Decode(&v), &dupErr)
+        }
+    }
+    var um map[interface{}]string
+    dec.ResetBytes(ints)
+    dec.SetDuplicateKeyPolicy(DuplicateKeysFirstWins)
+    require.NoError(t, dec.Decode(&um))
+    require.Equal(t, map[interface{}]string{int64(1): "x"}, um)
+}
+
+func TestInvalidUTF8(t *testing.T) {
+    in := []byte{0xa3, 0x61, 0xff, 0x62}
+
+    var s interface{}
+    require.NoError(t, Unmarshal(in, &s))
+    require.Equal(t, "a\xffb", s)
+
+    dec := NewDecoder(nil)
+    dec.ResetBytes(in)
+    dec.SetInvalidUTF8Policy(InvalidUTF8Reject)
+    err := dec.Decode(&s)
+    require.ErrorIs(t, err, ErrInvalidUTF8)
+    require.EqualError(t, err, "msgpack: invalid UTF-8 in string at offset 1")
+
+    dec.ResetBytes(in)
+    dec.SetInvalidUTF8Policy(InvalidUTF8Replace)
+    require.NoError(t, dec.Decode(&s))
+    require.Equal(t, "a�b", s)
+
+    var buf bytes.Buffer
+    enc := NewEncoder(&buf)
+    require.NoError(t, enc.EncodeString("a\xffb"))
+    require.Equal(t, in, buf.Bytes())
+
+    buf.Reset()
+    enc.SetInvalidUTF8Policy(InvalidUTF8Reject)
+    require.ErrorIs(t, enc.EncodeString("a\xffb"), ErrInvalidUTF8)
+    require.NoError(t, enc.EncodeString("ok"))
+    require.Equal(t, "a26f6b", hex.EncodeToString(buf.Bytes()))
+
+    buf.Reset()
+    enc.SetInvalidUTF8Policy(InvalidUTF8AsBin)
+    require.NoError(t, enc.EncodeString("a\xffb"))
+    require.Equal(t, "c40361ff62", hex.EncodeToString(buf.Bytes()))
+}
+
+func TestDecoderNextToken(t *testing.T) {
+    // {"N": [1, -1, 1.5], "B": bin(0x01), "E": fixext1(5, 0x02), "Z": nil, "T": true}
+    in := []byte{
+        0x85,
+        0xa1, 0x4e, 0x93, 0x01, 0xff, 0xcb, 0x3f, 0xf8, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+        0xa1, 0x42, 0xc4, 0x01, 0x01,
+        0xa1, 0x45, 0xd4, 0x05, 0x02,
+        0xa1, 0x5a, 0xc0,
+        0xa1, 0x54, 0xc3,
+    }
+
+    dec := NewDecoder(nil)
+    dec.ResetBytes(in)
+    var tokens []Token
+    for {
+        tok, err := dec.NextToken()
+        if err == io.EOF {
+            break
+        }
+        require.NoError(t, err)
+        tokens = append(tokens, tok)
+    }
+
+    require.Equal(t, []Token{
+        MapHeader(5),
+        "N", ArrayHeader(3), int64(1), int64(-1), 1.5,
+        "B", []byte{0x01},
+        "E", Ext{Type: 5, Data: []byte{0x02}},
+        "Z", nil,
+        "T", true,
+    }, tokens)
+
+    // str of 3 with no payload, and an array missing an element
+    for _, b := range [][]byte{{0xa3}, {0xa3, 0x61}, {0x92, 0x01}, {0x81, 0xa1, 0x61}} {
+        dec.ResetBytes(b)
+        var err error
+        for err == nil {
+            _, err = dec.NextToken()
+        }
+        require.Equal(t, io.ErrUnexpectedEOF, err, "% x", b)
+    }
+}
+
+func TestUnpacker(t *testing.T) {
+    // {"N": [1, "ab"]}, true
+    in := []byte{0x81, 0xa1, 0x4e, 0x92, 0x01, 0xa2, 0x61, 0x62, 0xc3}
+
+    u := NewUnpacker()
+    var v interface{}
+    require.Equal(t, ErrNeedMore, u.Unpack(&v))
+
+    for i := 0; i < 7; i++ {
+        u.Feed(in[i : i+1])
+        require.Equal(t, ErrNeedMore, u.Unpack(&v))
+        require.Equal(t, i+1, u.Buffered())
+    }
+
+    u.Feed(in[7:])
+    require.NoError(t, u.Unpack(&v))
+    require.Equal(t, map[string]interface{}{"N": []interface{}{int64(1), "ab"}}, v)
+    require.NoError(t, u.Unpack(&v))
+    require.Equal(t, true, v)
+    require.Equal(t, ErrNeedMore, u.Unpack(&v))
+    require.Equal(t, 0, u.Buffered())
+
+    dec := NewDecoder(io.MultiReader(bytes.NewReader(in)))
+    require.NoError(t, dec.Skip())
+    require.Equal(t, int64(8), dec.InputOffset())
+
+    dec.Reset(io.MultiReader(bytes.NewReader([]byte{0xdd, 0xff, 0xff, 0xff, 0xff})))
+    require.Equal(t, io.ErrUnexpectedEOF, dec.Skip())
+
+    // A large value fed in chunks is scanned as it arrives.
+    large := make([]int, 100000)
+    for i := range large {
+        large[i] = i
+    }
+    b, err := Marshal(large)
+    require.NoError(t, err)
+    for len(b) > 0 {
+        k := 4096
+        if k > len(b) {
+            k = len(b)
+        }
+        u.Feed(b[:k])
+        b = b[k:]
+        if len(b) > 0 {
+            require.Equal(t, ErrNeedMore, u.Unpack(&v))
+        }
+    }
+    var out []int
+    require.NoError(t, u.Unpack(&out))
+    require.Equal(t, large, out)
+
+    // A map32 claiming 2^32-1 entries needs more input, whatever the size
+    // of int.
+    u.Feed([]byte{0xdf, 0xff, 0xff, 0xff, 0xff, 0x01, 0x02})
+    require.Equal(t, ErrNeedMore, u.Unpack(&v))
+    require.Equal(t, 7, u.Buffered())
+}
+
+func TestDocument(t *testing.T) {
+    // {"a": [1, 2, 3, {"b": "x"}], 7: true}
+    in := []byte{0x82, 0xa1, 0x61, 0x94, 0x01, 0x02, 0x03, 0x81, 0xa1, 0x62, 0xa1, 0x78, 0x07, 0xc3}
+    doc := NewDocument(in)
+
+    v, err := doc.Get("a", 3, "b")
+    require.NoError(t, err)
+    require.Equal(t, "x", v)
+
+    v, err = doc.Get(uint8(7))
+    require.NoError(t, err)
+    require.Equal(t, true, v)
+
+    raw, err := doc.Raw("a", 3)
+    require.NoError(t, err)
+    require.Equal(t, []byte{0x81, 0xa1, 0x62, 0xa1, 0x78}, raw)
+
+    var n int
+    require.NoError(t, doc.Decode(&n, "a", 1))
+    require.Equal(t, 2, n)
+
+    _, err = doc.Get("a", 4)
+    require.ErrorIs(t, err, ErrNotFound)
+    _, err = doc.Get("a", 0, "c")
+    require.Error(t, err)
+
+    // {bin "k": 1, float 1.5: 2}
+    doc = NewDocument([]byte{0x82, 0xc4, 0x01, 0x6b, 0x01, 0xca, 0x3f, 0xc0, 0x00, 0x00, 0x02})
+    v, err = doc.Get([]byte("k"))
+    require.NoError(t, err)
+    require.Equal(t, int64(1), v)
+    _, err = doc.Get("k")
+    require.ErrorIs(t, err, ErrNotFound)
+    v, err = doc.Get(float32(1.5))
+    require.NoError(t, err)
+    require.Equal(t, int64(2), v)
+    _, err = doc.Get([]int{1})
+    require.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestValueRoundTrip(t *testing.T) {
+    // {str8 "s": 1 (uint16), "f": float 1.5, "b": bin "x", "e": ext8(1, 0x01), 2: [int8 -1, nil, true]}
+    in := []byte{
+        0x85,
+        0xd9, 0x01, 0x73, 0xcd, 0x00, 0x01,
+        0xa1, 0x66, 0xca, 0x3f, 0xc0, 0x00, 0x00,
+        0xa1, 0x62, 0xc4, 0x01, 0x78,
+        0xa1, 0x65, 0xc7, 0x01, 0x01, 0x01,
+        0x02, 0x93, 0xd0, 0xff, 0xc0, 0xc3,
+    }
+
+    var v Value
+    require.NoError(t, Unmarshal(in, &v))
+    require.Equal(t, KindMap, v.Kind())
+    require.Equal(t, 5, v.Len())
+
+    s, ok := v.Get("s")
+    require.True(t, ok)
+    require.Equal(t, KindUint, s.Kind())
+    require.Equal(t, uint64(1), s.Uint())
+
+    f, _ := v.Get("f")
+    require.Equal(t, KindFloat, f.Kind())
+    require.Equal(t, 1.5, f.Float())
+
+    b, _ := v.Get("b")
+    require.Equal(t, KindBin, b.Kind())
+    e, _ := v.Get("e")
+    require.Equal(t, Ext{Type: 1, Data: []byte{0x01}}, e.Ext())
+    require.Equal(t, int64(-1), v.Pairs()[4].Value.Index(0).Int())
+
+    out, err := Marshal(v)
+    require.NoError(t, err)
+    require.Equal(t, in, out)
+
+    built := MapValue(
+        ValuePair{StrValue("s"), UintValue(1)},
+        ValuePair{StrValue("f"), FloatValue(1.5)},
+        ValuePair{StrValue("b"), BinValue([]byte("x"))},
+        ValuePair{StrValue("e"), ExtValue(1, []byte{0x01})},
+        ValuePair{IntValue(2), ArrayValue(IntValue(-1), NilValue(), BoolValue(true))},
+    )
+    require.True(t, built.Equal(v))
+    out, err = Marshal(built)
+    require.NoError(t, err)
+    require.Equal(t, "85a17301a166ca3fc00000a162c40178a165d401010293ffc0c3", hex.EncodeToString(out))
+
+    j, err := json.Marshal(v)
+    require.NoError(t, err)
+    require.Equal(t, `{"s":1,"f":1.5,"b":"eA==","e":{"type":1,"data":"AQ=="},"2":[-1,null,true]}`, string(j))
+}
+
+func TestDecoderLowLevel(t *testing.T) {
+    // [-2, uint64 max, float 0.5, double 2, "ab", ext1(3, 0x04), nil]
+    in := []byte{
+        0x97, 0xfe,
+        0xcf, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+        0xca, 0x3f, 0x00, 0x00, 0x00,
+        0xcb, 0x40, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+        0xa2, 0x61, 0x62,
+        0xd4, 0x03, 0x04,
+        0xc0,
+    }
+    dec := NewDecoder(bytes.NewReader(in))
+
+    n, err := dec.DecodeArrayLen()
+    require.NoError(t, err)
+    require.Equal(t, 7, n)
+
+    i, err := dec.DecodeInt64()
+    require.NoError(t, err)
+    require.Equal(t, int64(-2), i)
+
+    c, err := dec.PeekCode()
+    require.NoError(t, err)
+    require.Equal(t, Uint64, c)
+    u, err := dec.DecodeUint64()
+    require.NoError(t, err)
+    require.Equal(t, uint64(math.MaxUint64), u)
+
+    f32, err := dec.DecodeFloat32()
+    require.NoError(t, err)
+    require.Equal(t, float32(0.5), f32)
+
+    f64, err := dec.DecodeFloat64()
+    require.NoError(t, err)
+    require.Equal(t, 2.0, f64)
+
+    l, err := dec.DecodeBytesLen()
+    require.NoError(t, err)
+    b := make([]byte, l)
+    require.NoError(t, dec.ReadFull(b))
+    require.Equal(t, "ab", string(b))
+
+    typ, l, err := dec.DecodeExtHeader()
+    require.NoError(t, err)
+    require.Equal(t, int8(3), typ)
+    require.Equal(t, 1, l)
+    require.NoError(t, dec.ReadFull(b[:l]))
+    require.Equal(t, byte(0x04), b[0])
+
+    require.NoError(t, dec.DecodeNil())
+    require.Equal(t, int64(len(in)), dec.InputOffset())
+
+    dec.ResetBytes([]byte{0xff})
+    _, err = dec.DecodeUint64()
+    require.EqualError(t, err, "msgpack: value -1 overflows uint64")
+
+    dec.ResetBytes(in[2:11])
+    _, err = dec.DecodeInt64()
+    require.EqualError(t, err, "msgpack: value 18446744073709551615 overflows int64")
+
+    // array16 of 16 zeros and array32 of one true
+    dec.ResetBytes(append([]byte{0xdc, 0x00, 0x10}, make([]byte, 16)...))
+    v, err := dec.DecodeInterface()
+    require.NoError(t, err)
+    require.Len(t, v, 16)
+    dec.ResetBytes([]byte{0xdd, 0x00, 0x00, 0x00, 0x01, 0xc3})
+    v, err = dec.DecodeInterface()
+    require.NoError(t, err)
+    require.Equal(t, []interface{}{true}, v)
+}
+
+func TestEncoderLowLevel(t *testing.T) {
+    var buf bytes.Buffer
+    enc := NewEncoder(&buf)
+
+    require.NoError(t, enc.EncodeArrayLen(7))
+    require.NoError(t, enc.EncodeFloat32(0.5))
+    require.NoError(t, enc.EncodeBytes([]byte{0x01, 0x02}))
+    require.NoError(t, enc.EncodeBytes(nil))
+    require.NoError(t, enc.EncodeStringLen(2))
+    require.NoError(t, enc.EncodeRaw([]byte("ab")))
+    require.NoError(t, enc.EncodeBinLen(300))
+    require.NoError(t, enc.EncodeRaw(make([]byte, 300)))
+    require.NoError(t, enc.EncodeExtHeader(-1, 4))
+    require.NoError(t, enc.EncodeRaw([]byte{0, 0, 0, 1}))
+    require.NoError(t, enc.EncodeExt(5, []byte{1, 2, 3}))
+
+    b := buf.Bytes()
+    require.Equal(t, "97ca3f000000c4020102c0a26162c5012c", hex.EncodeToString(b[:17]))
+    require.Equal(t, "d6ff00000001c70305010203", hex.EncodeToString(b[317:]))
+
+    var v Value
+    require.NoError(t, Unmarshal(b, &v))
+    require.Equal(t, KindBin, v.Index(4).Kind())
+    require.Equal(t, Ext{Type: 5, Data: []byte{1, 2, 3}}, v.Index(6).Ext())
+
+    b, err := Marshal(map[string]interface{}{"B": []byte("x"), "F": float32(1)})
+    require.NoError(t, err)
+    require.Equal(t, "82a142c40178a146ca3f800000", hex.EncodeToString(b))
+
+    lenWriters := []func(int) error{
+        enc.EncodeArrayLen, enc.EncodeMapLen, enc.EncodeStringLen, enc.EncodeBinLen,
+        func(l int) error { return enc.EncodeExtHeader(1, l) },
+    }
+    tooLong := uint64(math.MaxUint32) + 1
+    for i, fn := range lenWriters {
+        buf.Reset()
+        require.Error(t, fn(-1), "#%d", i)
+        if math.MaxInt > math.MaxUint32 {
+            require.Error(t, fn(int(tooLong)), "#%d", i)
+            require.Equal(t, 0, buf.Len(), "#%d", i)
+            require.NoError(t, fn(int(tooLong-1)), "#%d", i)
+        }
+    }
+    if math.MaxInt > math.MaxUint32 {
+        require.Equal(t, "c9ffffffff01", hex.EncodeToString(buf.Bytes()))
+    }
+}
+
+func TestEncoderOpenContainers(t *testing.T) {
+    var buf bytes.Buffer
+    enc := NewEncoder(&buf)
+
+    require.NoError(t, enc.BeginMap())
+    require.NoError(t, enc.EncodeString("a"))
+    require.NoError(t, enc.BeginArray())
+    for i := 0; i < 20; i++ {
+        require.NoError(t, enc.EncodeInt(int64(i)))
+    }
+    require.NoError(t, enc.EndArray())
+    require.NoError(t, enc.EncodeString("b"))
+    require.NoError(t, enc.Encode([]int{1}))
+    require.Equal(t, 0, buf.Len())
+    require.NoError(t, enc.EndMap())
+
+    var v map[string][]int
+    require.NoError(t, Unmarshal(buf.Bytes(), &v))
+    require.Len(t, v["a"], 20)
+    require.Equal(t, []int{1}, v["b"])
+    require.Equal(t, "82a161dc0014", hex.EncodeToString(buf.Bytes()[:6]))
+
+    buf.Reset()
+    enc.UseFixedContainerHeaders(true)
+    require.NoError(t, enc.BeginArray())
+    require.NoError(t, enc.EncodeBool(true))
+    require.NoError(t, enc.EndArray())
+    require.Equal(t, "dd00000001c3", hex.EncodeToString(buf.Bytes()))
+
+    require.Error(t, enc.EndArray())
+    require.NoError(t, enc.BeginMap())
+    require.NoError(t, enc.EncodeString("k"))
+    require.Error(t, enc.EndArray())
+    require.Error(t, enc.EndMap())
+    require.NoError(t, enc.EncodeNil())
+    require.NoError(t, enc.EndMap())
+    require.Equal(t, "dd00000001c3df00000001a16bc0", hex.EncodeToString(buf.Bytes()))
+
+    // Values written with low-level headers and EncodeRaw count once.
+    buf.Reset()
+    enc.UseFixedContainerHeaders(false)
+    require.NoError(t, enc.BeginArray())
+    require.NoError(t, enc.EncodeArrayLen(2))
+    require.NoError(t, enc.BeginMap())
+    require.NoError(t, enc.EndMap())
+    require.NoError(t, enc.EncodeExt(1, []byte{1, 2, 3, 4}))
+    require.NoError(t, enc.EncodeStringLen(3))
+    require.NoError(t, enc.EncodeRaw([]byte("ab")))
+    require.Error(t, enc.EndArray())
+    require.NoError(t, enc.EncodeRaw([]byte{'c', 0x92, 0x01}))
+    require.NoError(t, enc.EncodeRaw([]byte{0xcd, 0x01}))
+    require.NoError(t, enc.EncodeRaw([]byte{0x00}))
+    require.NoError(t, enc.EndArray())
+    require.Equal(t, "93" + "9280d60101020304" + "a3616263" + "9201cd0100", hex.EncodeToString(buf.Bytes()))
+
+    // Nested containers are written in one pass.
+    buf.Reset()
+    const depth = 3000
+    for i := 0; i < depth; i++ {
+        require.NoError(t, enc.BeginArray())
+        require.NoError(t, enc.EncodeInt(int64(i)))
+    }
+    for i := 0; i < depth; i++ {
+        require.NoError(t, enc.EndArray())
+    }
+    dec := NewDecoder(bytes.NewReader(buf.Bytes()))
+    for i := 0; i < depth; i++ {
+        n, err := dec.DecodeArrayLen()
+        require.NoError(t, err)
+        if i < depth-1 {
+            require.Equal(t, 2, n)
+        } else {
+            require.Equal(t, 1, n)
+        }
+        v, err := dec.DecodeInt64()
+        require.NoError(t, err)
+        require.Equal(t, int64(i), v)
+    }
+}
+
+func TestBuilder(t *testing.T) {
+    b, err := NewBuilder().
+        Map(2).
+        Str("id").Int(7).
+        Str("tags").Array(2).Str("a").Str("b").
+        Bytes()
+    require.NoError(t, err)
+
+    expected, err := Marshal(map[string]interface{}{"id": 7, "tags": []string{"a", "b"}})
+    require.NoError(t, err)
+    require.Equal(t, expected, b)
+
+    b, err = NewBuilder().Array(3).Nil().Bin([]byte{1}).Map(0).Bytes()
+    require.NoError(t, err)
+    require.Equal(t, "93c0c4010180", hex.EncodeToString(b))
+
+    _, err = NewBuilder().Map(1).Str("k").Bytes()
+    require.EqualError(t, err, "msgpack: Builder: map of 1 entries is missing 1 children")
+
+    _, err = NewBuilder().Array(1).Int(1).Int(2).Bytes()
+    require.EqualError(t, err, "msgpack: Builder: message is already complete")
+
+    _, err = NewBuilder().Bytes()
+    require.Error(t, err)
+
+    // Nothing is written after the message is complete.
+    bl := NewBuilder().Int(1)
+    bl.Int(2).Str("x")
+    require.Equal(t, 1, bl.Encoder().Writer().(*bytes.Buffer).Len())
+
+    _, err = NewBuilder().Array(-1).Bytes()
+    require.EqualError(t, err, "msgpack: Builder: array of -1 elements")
+    _, err = NewBuilder().Array(1).Map(-2).Bytes()
+    require.EqualError(t, err, "msgpack: Builder: map of -2 entries")
+}
+
+func TestEncodedSize(t *testing.T) {
+    values := []interface{}{
+        nil,
+        true,
+        map[string]interface{}{"M": 0.1, "N": -33, "O": []int{0, 200, 70000, 1 << 40}},
+        []uint8{1, 2, 3},
+        []interface{}{string(make([]byte, 40)), string(make([]byte, 300)), float32(1), uint(1 << 33)},
+        OrderedMap{{Key: 1, Value: Ext{Type: 1, Data: make([]byte, 3)}}},
+        MapValue(ValuePair{StrValue("a"), ArrayValue(IntValue(-200))}),
+        make([]int, 20),
+    }
+    for i, v := range values {
+        b, err := Marshal(v)
+        require.NoError(t, err, "#%d", i)
+        n, err := EncodedSize(v)
+        require.NoError(t, err, "#%d", i)
+        require.Equal(t, len(b), n, "#%d", i)
+    }
+
+    // Every format boundary of the encoder.
+    var bounds []interface{}
+    for _, n := range []int64{0, 127, 128, 255, 256, 65535, 65536, math.MaxUint32, math.MaxUint32 + 1, math.MaxInt64} {
+        bounds = append(bounds, n, uint64(n), -n, -n-1)
+    }
+    bounds = append(bounds, int64(-32), int64(-33), int64(math.MinInt8), int64(math.MinInt8-1),
+        int64(math.MinInt16), int64(math.MinInt16-1), int64(math.MinInt32), int64(math.MinInt32-1),
+        uint64(math.MaxUint64), int8(-1), uint16(300), float32(0.5), 0.5)
+    for _, l := range []int{0, 1, 2, 3, 4, 5, 8, 15, 16, 17, 31, 32, 255, 256, 65535, 65536} {
+        bounds = append(bounds, string(make([]byte, l)), make([]byte, l), BinKey(make([]byte, l)),
+            Ext{Type: 1, Data: make([]byte, l)}, make([]bool, l), OrderedMap(make([]KeyValue, l)))
+        m := make(map[int]bool, l)
+        for i := 0; i < l; i++ {
+            m[i] = true
+        }
+        bounds = append(bounds, m)
+    }
+    one := 1
+    bounds = append(bounds, &one, (*int)(nil), fmt.Errorf("boom"), struct{ A, B int }{1, 2}, StrValue("x"))
+    for i, v := range bounds {
+        b, err := Marshal(v)
+        require.NoError(t, err, "bound #%d", i)
+        n, err := EncodedSize(v)
+        require.NoError(t, err, "bound #%d", i)
+        require.Equal(t, len(b), n, "bound #%d (%T)", i, v)
+    }
+
+    _, err := EncodedSize(map[string]interface{}{"M": make(chan int)})
+    require.Error(t, err)
+
+    m := map[string]interface{}{}
+    m["self"] = []interface{}{m}
+    _, err = EncodedSize(m)
+    var cycleErr *CycleError
+    require.ErrorAs(t, err, &cycleErr)
+    require.True(t, strings.HasPrefix(cycleErr.Path, "$.self[0].self[0]"), cycleErr.Path)
+}
+
+func TestEqualAndHash(t *testing.T) {
+    // {"a": 5, "b": 1.5} with fixint, fixstr and double
+    a := []byte{0x82, 0xa1, 0x61, 0x05, 0xa1, 0x62, 0xcb, 0x3f, 0xf8, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+    // {"b": 1.5, "a": 5} with float, str8, uint16 and map16
+    b := []byte{0xde, 0x00, 0x02, 0xd9, 0x01, 0x62, 0xca, 0x3f, 0xc0, 0x00, 0x00, 0xd9, 0x01, 0x61, 0xcd, 0x00, 0x05}
+    // {"a": 5, "b": bin 1.5}
+    c := []byte{0x82, 0xa1, 0x61, 0x05, 0xa1, 0x62, 0xc4, 0x01, 0x00}
+
+    eq, err := Equal(a, b)
+    require.NoError(t, err)
+    require.True(t, eq)
+
+    eq, err = Equal(a, c)
+    require.NoError(t, err)
+    require.False(t, eq)
+
+    ha, hb := sha256.New(), sha256.New()
+    require.NoError(t, Hash(a, ha))
+    require.NoError(t, Hash(b, hb))
+    require.Equal(t, ha.Sum(nil), hb.Sum(nil))
+
+    _, err = Equal(a, a[:3])
+    require.Error(t, err)
+}
+
+func TestDecoderRequireCanonical(t *testing.T) {
+    canonical, err := Marshal(map[string]interface{}{"a": 5, "bb": []int{300}, "c": "x"})
+    require.NoError(t, err)
+
+    dec := NewDecoder(nil)
+    var v interface{}
+    for _, stream := range []bool{false, true} {
+        reset := func(b []byte) {
+            if stream {
+                dec.Reset(io.MultiReader(bytes.NewReader(b)))
+            } else {
+                dec.ResetBytes(b)
+            }
+            dec.RequireCanonical(true)
+            dec.RequireSortedMapKeys(true)
+        }
+
+        reset(canonical)
+        require.NoError(t, dec.Decode(&v))
+        require.Equal(t, map[string]interface{}{"a": int64(5), "bb": []interface{}{uint64(300)}, "c": "x"}, v)
+
+        // {"a": uint16 5}
+        reset([]byte{0x81, 0xa1, 0x61, 0xcd, 0x00, 0x05})
+        err = dec.Decode(&v)
+        require.ErrorIs(t, err, ErrNotCanonical)
+        require.EqualError(t, err, "msgpack: not canonical: integer 5 at offset 3")
+
+        // {str8 "a": 1}
+        reset([]byte{0x81, 0xd9, 0x01, 0x61, 0x01})
+        require.EqualError(t, dec.Decode(&v), "msgpack: not canonical: header for 1 bytes at offset 1")
+
+        // {"b": 1, "a": 2}
+        reset([]byte{0x82, 0xa1, 0x62, 0x01, 0xa1, 0x61, 0x02})
+        require.EqualError(t, dec.Decode(&v), "msgpack: not canonical: map key order at offset 4")
+
+        // array16 of 1
+        reset([]byte{0xdc, 0x00, 0x01, 0xc0})
+        require.ErrorIs(t, dec.Decode(&v), ErrNotCanonical)
+    }
+
+    dec.ResetBytes([]byte{0x82, 0xa1, 0x62, 0x01, 0xa1, 0x61, 0x02})
+    dec.RequireCanonical(true)
+    require.NoError(t, dec.Decode(&v))
+
+    // Go map keys of mixed numeric types are written in canonical order.
+    mixed := map[interface{}]interface{}{
+        int(5): "a", uint(3): "b", int8(-1): "c", uint64(1 << 63): "d",
+        float32(2.5): "e", float64(1.5): "f", "s": "g", true: "h", nil: "i",
+    }
+    b, err := Marshal(mixed)
+    require.NoError(t, err)
+    dec.ResetBytes(b)
+    dec.RequireSortedMapKeys(true)
+    require.NoError(t, dec.Decode(&v))
+    require.Len(t, v, len(mixed))
+
+    _, err = Marshal(map[[2]byte]int{{1, 2}: 1, {3, 4}: 2})
+    var typeErr *UnsupportedTypeError
+    require.ErrorAs(t, err, &typeErr)
+}
+
+func TestEncoderCycleAndDepth(t *testing.T) {
+    m := map[string]interface{}{}
+    m["N"] = map[string]interface{}{"M": []interface{}{0, 1, m}}
+    _, err := Marshal(m)
+    var cycleErr *CycleError
+    require.ErrorAs(t, err, &cycleErr)
+    require.True(t, strings.HasPrefix(cycleErr.Path, "$.N.M[2].N.M[2]"), cycleErr.Path)
+
+    s := make([]interface{}, 1)
+    s[0] = s
+    _, err = Marshal(s)
+    require.ErrorAs(t, err, &cycleErr)
+
+    var nested interface{} = 1
+    for i := 0; i < 5; i++ {
+        nested = []interface{}{nested}
+    }
+    var buf bytes.Buffer
+    enc := NewEncoder(&buf)
+    enc.SetMaxDepth(4)
+    err = enc.Encode(nested)
+    var depthErr *MaxDepthError
+    require.ErrorAs(t, err, &depthErr)
+    require.Equal(t, "msgpack: exceeded max depth of 4 at $[0][0][0][0]", err.Error())
+
+    buf.Reset()
+    enc.SetMaxDepth(5)
+    require.NoError(t, enc.Encode(nested))
+}
+
+func TestEncoderErrorPath(t *testing.T) {
+    in := map[string]interface{}{
+        "N": map[string]interface{}{"M": []interface{}{1, "a", make(chan int)}},
+    }
+    _, err := Marshal(in)
+    var typeErr *UnsupportedTypeError
+    require.ErrorAs(t, err, &typeErr)
+    require.Equal(t, "$.N.M[2]", typeErr.Path)
+    require.Equal(t, reflect.TypeOf(make(chan int)), typeErr.Type)
+
+    _, err = EncodedSize(in)
+    require.ErrorAs(t, err, &typeErr)
+    require.Equal(t, "$.N.M[2]", typeErr.Path)
+
+    var buf bytes.Buffer
+    enc := NewEncoder(&buf)
+    enc.SetInvalidUTF8Policy(InvalidUTF8Reject)
+    err = enc.Encode(map[int][]string{7: {"ok", "a\xffb"}})
+    var valueErr *UnsupportedValueError
+    require.ErrorAs(t, err, &valueErr)
+    require.Equal(t, "$[7][1]", valueErr.Path)
+    require.ErrorIs(t, err, ErrInvalidUTF8)
+
+    _, err = Marshal(map[string]interface{}{"p": unsafe.Pointer(nil)})
+    require.ErrorAs(t, err, &typeErr)
+    require.Equal(t, "$.p", typeErr.Path)
+}
+
+type testHeader struct {
+    ID      int    `msgpack:"id"`
+    Version string `msgpack:"version,omitempty"`
+}
+
+type testMeta struct {
+    Owner string
+}
+
+type Audit struct {
+    CreatedBy string `msgpack:"created_by"`
+}
+
+type testResource struct {
+    testHeader
+    *Audit
+    Name  string                 `msgpack:"name"`
+    Spec  testMeta               `msgpack:",inline"`
+    Extra map[string]interface{} `msgpack:",inline"`
+    Skip  int                    `msgpack:"-"`
+}
+
+func TestStructInline(t *testing.T) {
+    in := testResource{
+        testHeader: testHeader{ID: 7},
+        Name:       "a",
+        Spec:       testMeta{Owner: "b"},
+        Extra:      map[string]interface{}{"z": true},
+        Skip:       1,
+    }
+    b, err := Marshal(in)
+    require.NoError(t, err)
+
+    var m map[string]interface{}
+    require.NoError(t, Unmarshal(b, &m))
+    require.Equal(t, map[string]interface{}{
+        "id": int64(7), "name": "a", "Owner": "b", "z": true,
+    }, m)
+
+    size, err := EncodedSize(in)
+    require.NoError(t, err)
+    require.Equal(t, len(b), size)
+
+    var out testResource
+    require.NoError(t, Unmarshal(b, &out))
+    in.Skip = 0
+    require.Equal(t, in, out)
+
+    in.Audit = &Audit{CreatedBy: "c"}
+    b, err = Marshal(in)
+    require.NoError(t, err)
+    out = testResource{}
+    require.NoError(t, Unmarshal(b, &out))
+    require.Equal(t, in, out)
+
+    b, err = Marshal(map[string]interface{}{"id": 1, "version": "v2", "x": "y"})
+    require.NoError(t, err)
+    var h testHeader
+    require.NoError(t, Unmarshal(b, &h))
+    require.Equal(t, testHeader{ID: 1, Version: "v2"}, h)
+
+    in.Extra["name"] = "dup"
+    _, err = Marshal(in)
+    require.Error(t, err)
+
+    // {"a": 1, "a": 2} and {"x": 1, "x": 2}
+    dupField := []byte{0x82, 0xa1, 0x61, 0x01, 0xa1, 0x61, 0x02}
+    dupInline := []byte{0x82, 0xa1, 0x78, 0x01, 0xa1, 0x78, 0x02}
+    var a struct {
+        A int `msgpack:"a"`
+    }
+    dec := NewDecoder(bytes.NewReader(dupField))
+    dec.SetDuplicateKeyPolicy(DuplicateKeysReject)
+    var dupErr *DuplicateKeyError
+    require.ErrorAs(t, dec.Decode(&a), &dupErr)
+    require.Equal(t, "a", dupErr.Key)
+    require.Equal(t, int64(4), dupErr.Offset)
+
+    dec.Reset(bytes.NewReader(dupField))
+    dec.SetDuplicateKeyPolicy(DuplicateKeysFirstWins)
+    require.NoError(t, dec.Decode(&a))
+    require.Equal(t, 1, a.A)
+
+    dec.Reset(bytes.NewReader(dupInline))
+    dec.SetDuplicateKeyPolicy(DuplicateKeysReject)
+    out = testResource{}
+    require.ErrorAs(t, dec.Decode(&out), &dupErr)
+    require.Equal(t, "x", dupErr.Key)
+}
+
+type testJSONTagged struct {
+    ID       int    `json:"id"`
+    Name     string `json:"name,omitempty"`
+    Internal string `json:"-"`
+    Own      string `json:"json_own" msgpack:"own"`
+}
+
+func TestCustomStructTag(t *testing.T) {
+    in := testJSONTagged{ID: 1, Internal: "x", Own: "o"}
+
+    var buf bytes.Buffer
+    enc := NewEncoder(&buf)
+    enc.SetCustomStructTag("json")
+    require.NoError(t, enc.Encode(in))
+
+    var m map[string]interface{}
+    require.NoError(t, Unmarshal(buf.Bytes(), &m))
+    require.Equal(t, map[string]interface{}{"id": int64(1), "json_own": "o"}, m)
+
+    dec := NewDecoder(bytes.NewReader(buf.Bytes()))
+    dec.SetCustomStructTag("json")
+    var out testJSONTagged
+    require.NoError(t, dec.Decode(&out))
+    require.Equal(t, testJSONTagged{ID: 1, Own: "o"}, out)
+
+    UseJSONTagFallback(true)
+    defer UseJSONTagFallback(false)
+    b, err := Marshal(in)
+    require.NoError(t, err)
+    m = nil
+    require.NoError(t, Unmarshal(b, &m))
+    require.Equal(t, map[string]interface{}{"id": int64(1), "own": "o"}, m)
+
+    out = testJSONTagged{}
+    require.NoError(t, Unmarshal(b, &out))
+    require.Equal(t, testJSONTagged{ID: 1, Own: "o"}, out)
+}
+
+func TestDynamicDuplicateKeys(t *testing.T) {
+    // {"a": 1, "a": 2}
+    in := []byte{0x82, 0xa1, 0x61, 0x01, 0xa1, 0x61, 0x02}
+
+    var v Value
+    require.NoError(t, Unmarshal(in, &v))
+    require.Equal(t, 2, v.Len())
+    last, ok := v.Get("a")
+    require.True(t, ok)
+    require.Equal(t, int64(2), last.Int())
+
+    dec0 := NewDecoder(bytes.NewReader(in))
+    dec0.SetMapDecoder(OrderedMapDecoder)
+    var om interface{}
+    require.NoError(t, dec0.Decode(&om))
+    require.Len(t, om, 2)
+    x, ok := om.(OrderedMap).Get("a")
+    require.True(t, ok)
+    require.Equal(t, int64(2), x)
+
+    dec := NewDecoder(bytes.NewReader(in))
+    dec.SetDuplicateKeyPolicy(DuplicateKeysFirstWins)
+    require.NoError(t, dec.Decode(&v))
+    require.Equal(t, 1, v.Len())
+    a, ok := v.Get("a")
+    require.True(t, ok)
+    require.Equal(t, int64(1), a.Int())
+
+    // {1: nil, uint8 1: nil}
+    dec.Reset(bytes.NewReader([]byte{0x82, 0x01, 0xc0, 0xcc, 0x01, 0xc0}))
+    dec.SetDuplicateKeyPolicy(DuplicateKeysReject)
+    var dupErr *DuplicateKeyError
+    require.ErrorAs(t, dec.Decode(&v), &dupErr)
+    require.Equal(t, int64(3), dupErr.Offset)
+
+    doc := NewDocument(in)
+    x, err := doc.Get("a")
+    require.NoError(t, err)
+    require.Equal(t, int64(2), x)
+    doc.SetDuplicateKeyPolicy(DuplicateKeysFirstWins)
+    x, err = doc.Get("a")
+    require.NoError(t, err)
+    require.Equal(t, int64(1), x)
+    doc.SetDuplicateKeyPolicy(DuplicateKeysReject)
+    _, err = doc.Get("a")
+    require.ErrorAs(t, err, &dupErr)
+    require.Equal(t, int64(4), dupErr.Offset)
+}
+
+type testNode struct {
+    *Audit
+    Name string
+    Next *testNode
+}
+
+func TestEncodePointers(t *testing.T) {
+    in := &testNode{Audit: &Audit{CreatedBy: "c"}, Name: "a", Next: &testNode{Name: "b"}}
+    b, err := Marshal(in)
+    require.NoError(t, err)
+    size, err := EncodedSize(in)
+    require.NoError(t, err)
+    require.Equal(t, len(b), size)
+
+    var out *testNode
+    require.NoError(t, Unmarshal(b, &out))
+    require.Equal(t, in, out)
+
+    var m map[string]interface{}
+    require.NoError(t, Unmarshal(b, &m))
+    require.Equal(t, "c", m["created_by"])
+    require.Nil(t, m["Next"].(map[string]interface{})["Next"])
+
+    in.Next.Next = in
+    _, err = Marshal(in)
+    var cycleErr *CycleError
+    require.ErrorAs(t, err, &cycleErr)
+    _, err = EncodedSize(in)
+    require.ErrorAs(t, err, &cycleErr)
+}
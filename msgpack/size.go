@@ -0,0 +1,255 @@
+package msgpack
+
+import (
+	"math"
+	"reflect"
+)
+
+// EncodedSize returns the exact number of bytes Marshal would produce for
+// v, without producing them. It follows the same rules as the Encoder, so
+// it fails for the same unsupported values.
+func EncodedSize(v interface{}) (int, error) {
+	s := new(sizer)
+	s.enc = NewEncoder(&s.w)
+	return s.sizeOfValue(reflect.ValueOf(v))
+}
+
+// sizer walks a value the way the Encoder does. Its Encoder tracks depth
+// and cycles, and encodes the few values that are simpler to measure by
+// encoding them.
+type sizer struct {
+	w   countingWriter
+	enc *Encoder
+}
+
+// encodedLen returns the number of bytes encode writes.
+func (s *sizer) encodedLen(encode func() error) (int, error) {
+	start := s.w
+	err := encode()
+	return int(s.w - start), err
+}
+
+func (s *sizer) sizeOfValue(v reflect.Value) (int, error) {
+	if !v.IsValid() {
+		return 1, nil
+	}
+
+	switch typ := v.Type(); typ {
+	case errorType:
+		if v.IsNil() {
+			return 1, nil
+		}
+		return stringSize(len(v.Interface().(error).Error())), nil
+	case orderedMapType:
+		if v.IsNil() {
+			return 1, nil
+		}
+		if err := s.enc.enter(v); err != nil {
+			return 0, err
+		}
+		defer s.enc.leave(v)
+
+		n := mapLenSize(v.Len())
+		for i := 0; i < v.Len(); i++ {
+			kv := v.Index(i)
+			size, err := s.sizeOfPair(kv.Field(0), kv.Field(1))
+			if err != nil {
+				return 0, wrapPath(err, keyPathSegment(kv.Field(0)))
+			}
+			n += size
+		}
+		return n, nil
+	case binKeyType:
+		return binLenSize(v.Len()) + v.Len(), nil
+	case extType:
+		l := len(v.Interface().(Ext).Data)
+		return extHeaderSize(l) + l, nil
+	case dynamicValueType:
+		return s.encodedLen(func() error {
+			return s.enc.EncodeDynamic(v.Interface().(Value))
+		})
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		return s.encodedLen(func() error {
+			return s.enc.EncodeValue(v)
+		})
+	case reflect.Bool:
+		return 1, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return intSize(v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return uintSize(v.Uint()), nil
+	case reflect.Float32:
+		return 5, nil
+	case reflect.Float64:
+		return 9, nil
+	case reflect.String:
+		return stringSize(v.Len()), nil
+	case reflect.Interface:
+		if v.IsNil() {
+			return 1, nil
+		}
+		return s.sizeOfValue(v.Elem())
+	case reflect.Ptr:
+		if v.IsNil() {
+			return 1, nil
+		}
+		if err := s.enc.enter(v); err != nil {
+			return 0, err
+		}
+		defer s.enc.leave(v)
+		return s.sizeOfValue(v.Elem())
+	case reflect.Map:
+		if v.IsNil() {
+			return 1, nil
+		}
+		if err := s.enc.enter(v); err != nil {
+			return 0, err
+		}
+		defer s.enc.leave(v)
+
+		n := mapLenSize(v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			size, err := s.sizeOfPair(iter.Key(), iter.Value())
+			if err != nil {
+				return 0, wrapPath(err, keyPathSegment(iter.Key()))
+			}
+			n += size
+		}
+		return n, nil
+	case reflect.Slice:
+		if v.IsNil() {
+			return 1, nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return binLenSize(v.Len()) + v.Len(), nil
+		}
+		if err := s.enc.enter(v); err != nil {
+			return 0, err
+		}
+		defer s.enc.leave(v)
+
+		n := arrayLenSize(v.Len())
+		for i := 0; i < v.Len(); i++ {
+			size, err := s.sizeOfValue(v.Index(i))
+			if err != nil {
+				return 0, wrapPath(err, indexPathSegment(i))
+			}
+			n += size
+		}
+		return n, nil
+	}
+	return 0, encodeUnsupported(nil, v)
+}
+
+func (s *sizer) sizeOfPair(k, v reflect.Value) (int, error) {
+	ks, err := s.sizeOfValue(k)
+	if err != nil {
+		return 0, err
+	}
+	vs, err := s.sizeOfValue(v)
+	if err != nil {
+		return 0, err
+	}
+	return ks + vs, nil
+}
+
+// intSize mirrors EncodeInt.
+func intSize(n int64) int {
+	switch {
+	case n >= 0:
+		return uintSize(uint64(n))
+	case n >= int64(int8(NegFixedNumLow)):
+		return 1
+	case n >= math.MinInt8:
+		return 2
+	case n >= math.MinInt16:
+		return 3
+	case n >= math.MinInt32:
+		return 5
+	}
+	return 9
+}
+
+// uintSize mirrors EncodeUint.
+func uintSize(n uint64) int {
+	switch {
+	case n <= math.MaxInt8:
+		return 1
+	case n <= math.MaxUint8:
+		return 2
+	case n <= math.MaxUint16:
+		return 3
+	case n <= math.MaxUint32:
+		return 5
+	}
+	return 9
+}
+
+// stringSize mirrors EncodeString.
+func stringSize(l int) int {
+	switch {
+	case l < 32:
+		return 1 + l
+	case l < 256:
+		return 2 + l
+	case l <= math.MaxUint16:
+		return 3 + l
+	}
+	return 5 + l
+}
+
+// binLenSize mirrors EncodeBinLen.
+func binLenSize(l int) int {
+	switch {
+	case l < 256:
+		return 2
+	case l <= math.MaxUint16:
+		return 3
+	}
+	return 5
+}
+
+// arrayLenSize mirrors EncodeArrayLen; EncodeMapLen uses the same widths.
+func arrayLenSize(l int) int {
+	switch {
+	case l < 16:
+		return 1
+	case l <= math.MaxUint16:
+		return 3
+	}
+	return 5
+}
+
+func mapLenSize(l int) int {
+	return arrayLenSize(l)
+}
+
+// extHeaderSize mirrors EncodeExtHeader.
+func extHeaderSize(l int) int {
+	switch {
+	case fixExtCode(l) != 0:
+		return 2
+	case l <= math.MaxUint8:
+		return 3
+	case l <= math.MaxUint16:
+		return 4
+	}
+	return 6
+}
+
+// countingWriter is a writer that only counts the bytes written to it.
+type countingWriter int
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	*w += countingWriter(len(b))
+	return len(b), nil
+}
+
+func (w *countingWriter) WriteByte(c byte) error {
+	*w++
+	return nil
+}
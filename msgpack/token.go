@@ -0,0 +1,88 @@
+package msgpack
+
+import "io"
+
+// Token is a single MessagePack item returned by Decoder.NextToken. It is
+// one of:
+//
+//	nil                 for nil
+//	bool                for true and false
+//	int64               for fixints and signed integers
+//	uint64              for unsigned integers
+//	float32, float64    for float and double
+//	string              for str
+//	[]byte              for bin
+//	Ext                 for ext
+//	ArrayHeader         for the start of an array
+//	MapHeader           for the start of a map
+type Token interface{}
+
+// ArrayHeader starts an array of the given number of elements. The
+// elements follow as the next tokens.
+type ArrayHeader int
+
+// MapHeader starts a map of the given number of entries. The keys and
+// values follow as the next tokens, alternating.
+type MapHeader int
+
+// NextToken reads the next item from the input without building
+// containers, so documents of any size can be walked in constant memory. It
+// returns io.EOF at the end of the input, and io.ErrUnexpectedEOF if the
+// input ends inside a token or an array or map.
+func (d *Decoder) NextToken() (Token, error) {
+	start := d.offset
+	tok, err := d.nextToken()
+	if err != nil {
+		if err == io.EOF && (d.offset != start || d.tokensOwed > 0) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	if d.tokensOwed > 0 {
+		d.tokensOwed--
+	}
+	switch h := tok.(type) {
+	case ArrayHeader:
+		d.tokensOwed += int64(h)
+	case MapHeader:
+		d.tokensOwed += 2 * int64(h)
+	}
+	return tok, nil
+}
+
+func (d *Decoder) nextToken() (Token, error) {
+	c, err := d.readCode()
+	if err != nil {
+		return nil, err
+	}
+
+	if IsFixedNum(c) {
+		return d.number(c)
+	}
+	if IsFixedMap(c) || c == Map16 || c == Map32 {
+		n, err := d.mapLen(c)
+		return MapHeader(n), err
+	}
+	if IsFixedArray(c) || c == Array16 || c == Array32 {
+		n, err := d.arrayLen(c)
+		return ArrayHeader(n), err
+	}
+	if IsString(c) {
+		return d.string(c)
+	}
+	if IsBin(c) {
+		return d.bytes(c)
+	}
+	if IsExt(c) {
+		return d.ext(c)
+	}
+
+	switch c {
+	case Nil:
+		return nil, nil
+	case False, True:
+		return d.bool(c)
+	}
+	return d.number(c)
+}
@@ -0,0 +1,82 @@
+package msgpack
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrNeedMore is returned by Unpacker.Unpack when the buffered input ends
+// before a complete value.
+var ErrNeedMore = errors.New("msgpack: need more data")
+
+// Unpacker decodes values from input that arrives in arbitrary chunks, for
+// callers that cannot block on an io.Reader. Chunks are added with Feed and
+// complete values are taken out with Unpack.
+type Unpacker struct {
+	buf []byte
+	dec *Decoder
+
+	// scanned is the length of the part of buf already found to belong to
+	// the next value, and pending the number of values still to be scanned
+	// after it. pending is 0 when no value has been started.
+	scanned int
+	pending int64
+}
+
+func NewUnpacker() *Unpacker {
+	dec := new(Decoder)
+	dec.ResetBytes(nil)
+	return &Unpacker{dec: dec}
+}
+
+// Feed appends chunk to the buffered input. The chunk is copied, so the
+// caller may reuse it.
+func (u *Unpacker) Feed(chunk []byte) {
+	u.buf = append(u.buf, chunk...)
+}
+
+// Unpack decodes the next complete value into v. If the buffered input ends
+// mid-value it returns ErrNeedMore and consumes nothing, so the call can be
+// repeated after the next Feed. A complete value that fails to decode into
+// v is consumed along with the error; malformed input is not, as its length
+// cannot be known.
+func (u *Unpacker) Unpack(v interface{}) error {
+	if len(u.buf) == 0 {
+		return ErrNeedMore
+	}
+
+	// Resume scanning where the previous call ran out of input, so a value
+	// fed in many chunks is scanned only once.
+	if u.pending == 0 {
+		u.pending = 1
+	}
+	u.dec.resetBytes(u.buf[u.scanned:])
+	left, off, err := u.dec.skipValues(u.pending)
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			u.scanned += int(off)
+			u.pending = left
+			return ErrNeedMore
+		}
+		return err
+	}
+
+	n := u.scanned + int(u.dec.InputOffset())
+	u.scanned, u.pending = 0, 0
+	b := u.buf[:n:n]
+	u.buf = u.buf[n:]
+
+	u.dec.resetBytes(b)
+	return u.dec.Decode(v)
+}
+
+// Buffered returns the number of bytes fed but not yet unpacked.
+func (u *Unpacker) Buffered() int {
+	return len(u.buf)
+}
+
+// Decoder returns the Decoder used for unpacking, for setting decoding
+// options.
+func (u *Unpacker) Decoder() *Decoder {
+	return u.dec
+}
@@ -0,0 +1,31 @@
+package msgpack
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf8"
+)
+
+// ErrInvalidUTF8 is returned under InvalidUTF8Reject for a str value or Go
+// string that is not valid UTF-8.
+var ErrInvalidUTF8 = errors.New("msgpack: invalid UTF-8 in string")
+
+// InvalidUTF8Policy selects how strings that are not valid UTF-8 are
+// handled by Encoder.SetInvalidUTF8Policy and Decoder.SetInvalidUTF8Policy.
+type InvalidUTF8Policy int
+
+const (
+	// InvalidUTF8Allow passes strings through unchanged. It is the default.
+	InvalidUTF8Allow InvalidUTF8Policy = iota
+	// InvalidUTF8Reject fails with an error wrapping ErrInvalidUTF8.
+	InvalidUTF8Reject
+	// InvalidUTF8Replace replaces each invalid byte sequence with U+FFFD.
+	InvalidUTF8Replace
+	// InvalidUTF8AsBin makes the Encoder write invalid strings as bin
+	// instead of str. The Decoder treats it like InvalidUTF8Allow.
+	InvalidUTF8AsBin
+)
+
+func replaceInvalidUTF8(s string) string {
+	return strings.ToValidUTF8(s, string(utf8.RuneError))
+}
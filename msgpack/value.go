@@ -0,0 +1,600 @@
+package msgpack
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// Kind is the MessagePack type of a Value.
+type Kind uint8
+
+const (
+	KindNil Kind = iota
+	KindBool
+	KindInt
+	KindUint
+	KindFloat
+	KindDouble
+	KindStr
+	KindBin
+	KindExt
+	KindArray
+	KindMap
+)
+
+var kindNames = [...]string{
+	KindNil:    "nil",
+	KindBool:   "bool",
+	KindInt:    "int",
+	KindUint:   "uint",
+	KindFloat:  "float",
+	KindDouble: "double",
+	KindStr:    "str",
+	KindBin:    "bin",
+	KindExt:    "ext",
+	KindArray:  "array",
+	KindMap:    "map",
+}
+
+func (k Kind) String() string {
+	if int(k) < len(kindNames) {
+		return kindNames[k]
+	}
+	return fmt.Sprintf("Kind(%d)", k)
+}
+
+// Value holds any MessagePack value together with its exact type. Unlike
+// DecodeInterface, decoding into a Value keeps str and bin, float and
+// double, and ext apart, and remembers the format code each item was
+// encoded with, so encoding a decoded Value reproduces the input bytes.
+// Values built with the constructors below are encoded in the smallest
+// format. The zero Value is nil.
+type Value struct {
+	kind    Kind
+	code    byte
+	hasCode bool
+
+	n    uint64
+	s    string
+	b    []byte
+	ext  int8
+	arr  []Value
+	dict []ValuePair
+}
+
+// ValuePair is an entry of a map Value.
+type ValuePair struct {
+	Key   Value
+	Value Value
+}
+
+var dynamicValueType = reflect.TypeOf(Value{})
+
+func NilValue() Value {
+	return Value{}
+}
+
+func BoolValue(b bool) Value {
+	v := Value{kind: KindBool}
+	if b {
+		v.n = 1
+	}
+	return v
+}
+
+func IntValue(n int64) Value {
+	return Value{kind: KindInt, n: uint64(n)}
+}
+
+func UintValue(n uint64) Value {
+	return Value{kind: KindUint, n: n}
+}
+
+func FloatValue(f float32) Value {
+	return Value{kind: KindFloat, n: uint64(math.Float32bits(f))}
+}
+
+func DoubleValue(f float64) Value {
+	return Value{kind: KindDouble, n: math.Float64bits(f)}
+}
+
+func StrValue(s string) Value {
+	return Value{kind: KindStr, s: s}
+}
+
+func BinValue(b []byte) Value {
+	return Value{kind: KindBin, b: b}
+}
+
+func ExtValue(typ int8, data []byte) Value {
+	return Value{kind: KindExt, ext: typ, b: data}
+}
+
+func ArrayValue(elems ...Value) Value {
+	return Value{kind: KindArray, arr: elems}
+}
+
+func MapValue(pairs ...ValuePair) Value {
+	return Value{kind: KindMap, dict: pairs}
+}
+
+func (v Value) Kind() Kind {
+	return v.kind
+}
+
+func (v Value) IsNil() bool {
+	return v.kind == KindNil
+}
+
+func (v Value) mustBe(k Kind) {
+	if v.kind != k {
+		panic(fmt.Sprintf("msgpack: Value.%s called on %s Value", k, v.kind))
+	}
+}
+
+func (v Value) Bool() bool {
+	v.mustBe(KindBool)
+	return v.n != 0
+}
+
+// Int returns the value of an int Value.
+func (v Value) Int() int64 {
+	v.mustBe(KindInt)
+	return int64(v.n)
+}
+
+// Uint returns the value of a uint Value.
+func (v Value) Uint() uint64 {
+	v.mustBe(KindUint)
+	return v.n
+}
+
+// Float returns the value of a float or double Value.
+func (v Value) Float() float64 {
+	if v.kind == KindFloat {
+		return float64(math.Float32frombits(uint32(v.n)))
+	}
+	v.mustBe(KindDouble)
+	return math.Float64frombits(v.n)
+}
+
+func (v Value) Str() string {
+	v.mustBe(KindStr)
+	return v.s
+}
+
+func (v Value) Bin() []byte {
+	v.mustBe(KindBin)
+	return v.b
+}
+
+func (v Value) Ext() Ext {
+	v.mustBe(KindExt)
+	return Ext{Type: v.ext, Data: v.b}
+}
+
+// Len returns the number of elements of an array Value or entries of a map
+// Value.
+func (v Value) Len() int {
+	if v.kind == KindMap {
+		return len(v.dict)
+	}
+	v.mustBe(KindArray)
+	return len(v.arr)
+}
+
+// Index returns the i'th element of an array Value.
+func (v Value) Index(i int) Value {
+	v.mustBe(KindArray)
+	return v.arr[i]
+}
+
+// Elems returns the elements of an array Value.
+func (v Value) Elems() []Value {
+	v.mustBe(KindArray)
+	return v.arr
+}
+
+// Pairs returns the entries of a map Value in encoded order.
+func (v Value) Pairs() []ValuePair {
+	v.mustBe(KindMap)
+	return v.dict
+}
+
+// Get returns the value of the last entry of a map Value whose key is the
+// str key, the one decoding into a Go map keeps by default.
+func (v Value) Get(key string) (Value, bool) {
+	v.mustBe(KindMap)
+	for i := len(v.dict) - 1; i >= 0; i-- {
+		if p := v.dict[i]; p.Key.kind == KindStr && p.Key.s == key {
+			return p.Value, true
+		}
+	}
+	return Value{}, false
+}
+
+// Equal reports whether v and w hold the same kind and content. The format
+// codes they were encoded with are not compared. Floats are compared by
+// their bits, so NaN equals itself.
+func (v Value) Equal(w Value) bool {
+	if v.kind != w.kind || v.n != w.n || v.s != w.s || v.ext != w.ext ||
+		!bytes.Equal(v.b, w.b) || len(v.arr) != len(w.arr) || len(v.dict) != len(w.dict) {
+		return false
+	}
+	for i := range v.arr {
+		if !v.arr[i].Equal(w.arr[i]) {
+			return false
+		}
+	}
+	for i := range v.dict {
+		if !v.dict[i].Key.Equal(w.dict[i].Key) || !v.dict[i].Value.Equal(w.dict[i].Value) {
+			return false
+		}
+	}
+	return true
+}
+
+// Interface returns v as DecodeInterface would have decoded it, with maps
+// as OrderedMap.
+func (v Value) Interface() interface{} {
+	switch v.kind {
+	case KindBool:
+		return v.Bool()
+	case KindInt:
+		return v.Int()
+	case KindUint:
+		return v.Uint()
+	case KindFloat:
+		return math.Float32frombits(uint32(v.n))
+	case KindDouble:
+		return v.Float()
+	case KindStr:
+		return v.s
+	case KindBin:
+		return v.b
+	case KindExt:
+		return v.Ext()
+	case KindArray:
+		s := make([]interface{}, len(v.arr))
+		for i, e := range v.arr {
+			s[i] = e.Interface()
+		}
+		return s
+	case KindMap:
+		m := make(OrderedMap, len(v.dict))
+		for i, p := range v.dict {
+			m[i] = KeyValue{Key: p.Key.Interface(), Value: p.Value.Interface()}
+		}
+		return m
+	}
+	return nil
+}
+
+// MarshalJSON renders v as JSON for debugging. Bin and ext data are base64
+// encoded, ext as {"type":n,"data":...}, and map keys that are not str are
+// written as their JSON text.
+func (v Value) MarshalJSON() ([]byte, error) {
+	switch v.kind {
+	case KindExt:
+		return json.Marshal(struct {
+			Type int8   `json:"type"`
+			Data []byte `json:"data"`
+		}{v.ext, v.b})
+	case KindArray:
+		var buf bytes.Buffer
+		buf.WriteByte('[')
+		for i, e := range v.arr {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			b, err := e.MarshalJSON()
+			if err != nil {
+				return nil, err
+			}
+			buf.Write(b)
+		}
+		buf.WriteByte(']')
+		return buf.Bytes(), nil
+	case KindMap:
+		var buf bytes.Buffer
+		buf.WriteByte('{')
+		for i, p := range v.dict {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			key := p.Key.s
+			if p.Key.kind != KindStr {
+				b, err := p.Key.MarshalJSON()
+				if err != nil {
+					return nil, err
+				}
+				key = string(b)
+			}
+			b, err := json.Marshal(key)
+			if err != nil {
+				return nil, err
+			}
+			buf.Write(b)
+			buf.WriteByte(':')
+			if b, err = p.Value.MarshalJSON(); err != nil {
+				return nil, err
+			}
+			buf.Write(b)
+		}
+		buf.WriteByte('}')
+		return buf.Bytes(), nil
+	}
+	return json.Marshal(v.Interface())
+}
+
+//--------------------------------------------------
+
+// DecodeDynamic decodes the next value as a Value.
+func (d *Decoder) DecodeDynamic() (Value, error) {
+	c, err := d.readCode()
+	if err != nil {
+		return Value{}, err
+	}
+	v := Value{code: c, hasCode: true}
+
+	switch {
+	case c <= PosFixedNumHigh || c >= NegFixedNumLow:
+		v.kind = KindInt
+		v.n = uint64(int64(int8(c)))
+		return v, nil
+	case IsString(c):
+		v.kind = KindStr
+		v.s, err = d.string(c)
+		return v, err
+	case IsBin(c):
+		v.kind = KindBin
+		v.b, err = d.bytes(c)
+		return v, err
+	case IsExt(c):
+		v.kind = KindExt
+		e, err := d.ext(c)
+		v.ext, v.b = e.Type, e.Data
+		return v, err
+	case IsFixedArray(c) || c == Array16 || c == Array32:
+		n, err := d.arrayLen(c)
+		if err != nil {
+			return Value{}, err
+		}
+		v.kind = KindArray
+		v.arr = make([]Value, 0, min(n, sliceAllocLimit))
+		for i := 0; i < n; i++ {
+			e, err := d.DecodeDynamic()
+			if err != nil {
+				return Value{}, err
+			}
+			v.arr = append(v.arr, e)
+		}
+		return v, nil
+	case IsFixedMap(c) || c == Map16 || c == Map32:
+		n, err := d.mapLen(c)
+		if err != nil {
+			return Value{}, err
+		}
+		v.kind = KindMap
+		v.dict = make([]ValuePair, 0, min(n, maxMapSize))
+
+		// Like OrderedMap, a Value keeps every entry under
+		// DuplicateKeysLastWins. Keys are compared in canonical form.
+		var (
+			seen map[string]struct{}
+			ck   bytes.Buffer
+			enc  *Encoder
+		)
+		if d.dupKeys != DuplicateKeysLastWins {
+			seen = make(map[string]struct{}, min(n, maxMapSize))
+			enc = NewEncoder(&ck)
+		}
+
+		for i := 0; i < n; i++ {
+			off := d.offset
+			k, err := d.DecodeDynamic()
+			if err != nil {
+				return Value{}, err
+			}
+			e, err := d.DecodeDynamic()
+			if err != nil {
+				return Value{}, err
+			}
+			if seen != nil {
+				ck.Reset()
+				if err := enc.EncodeDynamic(canonicalValue(k)); err != nil {
+					return Value{}, err
+				}
+				if _, ok := seen[string(ck.Bytes())]; ok {
+					if _, err := d.keepDuplicate(k.Interface(), off); err != nil {
+						return Value{}, err
+					}
+					continue
+				}
+				seen[ck.String()] = struct{}{}
+			}
+			v.dict = append(v.dict, ValuePair{Key: k, Value: e})
+		}
+		return v, nil
+	}
+
+	switch c {
+	case Nil:
+		v.kind = KindNil
+	case False, True:
+		v.kind = KindBool
+		if c == True {
+			v.n = 1
+		}
+	case Float:
+		v.kind = KindFloat
+		n, err := d.uint32()
+		if err != nil {
+			return Value{}, err
+		}
+		v.n = uint64(n)
+	case Double:
+		v.kind = KindDouble
+		v.n, err = d.uint64()
+	case Uint8, Uint16, Uint32, Uint64:
+		v.kind = KindUint
+		v.n, err = d.uint(c)
+	case Int8, Int16, Int32, Int64:
+		v.kind = KindInt
+		var n int64
+		n, err = d.int(c)
+		v.n = uint64(n)
+	default:
+		return Value{}, unexpectedCodeError{code: c, hint: "Value"}
+	}
+	return v, err
+}
+
+// EncodeDynamic encodes v, using the format codes it was decoded with where
+// they can still hold its content.
+func (e *Encoder) EncodeDynamic(v Value) error {
+	switch v.kind {
+	case KindNil:
+		return e.EncodeNil()
+	case KindBool:
+		return e.EncodeBool(v.n != 0)
+	case KindInt:
+		n := int64(v.n)
+		if v.hasCode {
+			switch {
+			case v.code <= PosFixedNumHigh || v.code >= NegFixedNumLow:
+				return e.writeCode(byte(n))
+			case v.code == Int8:
+				return e.EncodeInt8(int8(n))
+			case v.code == Int16:
+				return e.EncodeInt16(int16(n))
+			case v.code == Int32:
+				return e.EncodeInt32(int32(n))
+			case v.code == Int64:
+				return e.EncodeInt64(n)
+			}
+		}
+		return e.EncodeInt(n)
+	case KindUint:
+		if v.hasCode {
+			switch v.code {
+			case Uint8:
+				return e.EncodeUint8(uint8(v.n))
+			case Uint16:
+				return e.EncodeUint16(uint16(v.n))
+			case Uint32:
+				return e.EncodeUint32(uint32(v.n))
+			case Uint64:
+				return e.EncodeUint64(v.n)
+			}
+		}
+		return e.EncodeUint(v.n)
+	case KindFloat:
+		return e.write4(Float, uint32(v.n))
+	case KindDouble:
+		return e.write8(Double, v.n)
+	case KindStr:
+		if err := e.encodeDynamicLen(v, e.EncodeStringLen, len(v.s)); err != nil {
+			return err
+		}
+		return e.writeString(v.s)
+	case KindBin:
+		if err := e.encodeDynamicLen(v, e.EncodeBinLen, len(v.b)); err != nil {
+			return err
+		}
+		return e.write(v.b)
+	case KindExt:
+		if err := e.encodeDynamicLen(v, func(l int) error {
+			return e.EncodeExtHeader(v.ext, l)
+		}, len(v.b)); err != nil {
+			return err
+		}
+		return e.write(v.b)
+	case KindArray:
+		if err := e.encodeDynamicLen(v, e.EncodeArrayLen, len(v.arr)); err != nil {
+			return err
+		}
+		for _, el := range v.arr {
+			if err := e.EncodeDynamic(el); err != nil {
+				return err
+			}
+		}
+		return nil
+	case KindMap:
+		if err := e.encodeDynamicLen(v, e.EncodeMapLen, len(v.dict)); err != nil {
+			return err
+		}
+		for _, p := range v.dict {
+			if err := e.EncodeDynamic(p.Key); err != nil {
+				return err
+			}
+			if err := e.EncodeDynamic(p.Value); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("msgpack: invalid Value kind %s", v.kind)
+}
+
+// encodeDynamicLen writes the header of a str, bin, ext, array or map Value
+// of length l in the format it was decoded with, falling back to minimal to
+// write the smallest header.
+func (e *Encoder) encodeDynamicLen(v Value, minimal func(int) error, l int) error {
+	if !v.hasCode {
+		return minimal(l)
+	}
+
+	c := v.code
+	switch {
+	case IsFixedString(c) && l <= int(FixedStrMask):
+		return e.writeCode(FixedStrLow | byte(l))
+	case IsFixedArray(c) && l <= int(FixedArrayMask):
+		return e.writeCode(FixedArrayLow | byte(l))
+	case IsFixedMap(c) && l <= int(FixedMapMask):
+		return e.writeCode(FixedMapLow | byte(l))
+	case IsFixedExt(c) && c == fixExtCode(l):
+		if err := e.writeCode(c); err != nil {
+			return err
+		}
+		return e.writeCode(byte(v.ext))
+	case (c == Str8 || c == Bin8) && l <= math.MaxUint8:
+		return e.write1(c, uint8(l))
+	case (c == Str16 || c == Bin16 || c == Array16 || c == Map16) && l <= math.MaxUint16:
+		return e.write2(c, uint16(l))
+	case c == Str32 || c == Bin32 || c == Array32 || c == Map32:
+		return e.write4(c, uint32(l))
+	case c == Ext8 && l <= math.MaxUint8:
+		if err := e.write1(c, uint8(l)); err != nil {
+			return err
+		}
+		return e.writeCode(byte(v.ext))
+	case c == Ext16 && l <= math.MaxUint16:
+		if err := e.write2(c, uint16(l)); err != nil {
+			return err
+		}
+		return e.writeCode(byte(v.ext))
+	case c == Ext32:
+		if err := e.write4(c, uint32(l)); err != nil {
+			return err
+		}
+		return e.writeCode(byte(v.ext))
+	}
+	return minimal(l)
+}
+
+func encodeDynamicValue(e *Encoder, v reflect.Value) error {
+	return e.EncodeDynamic(v.Interface().(Value))
+}
+
+func decodeDynamicValue(d *Decoder, v reflect.Value) error {
+	dv, err := d.DecodeDynamic()
+	if err != nil {
+		return err
+	}
+	v.Set(reflect.ValueOf(dv))
+	return nil
+}